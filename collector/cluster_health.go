@@ -227,8 +227,7 @@ func (c *ClusterHealth) fetchAndDecodeClusterHealth() (clusterHealthResponse, er
 	u.Path = "/_cluster/health"
 	res, err := c.client.Get(u.String())
 	if err != nil {
-		return chr, fmt.Errorf("failed to get cluster health from %s://%s:%s/%s: %s",
-			u.Scheme, u.Hostname(), u.Port(), u.Path, err)
+		return chr, fmt.Errorf("failed to get cluster health from %s: %s", u.Redacted(), err)
 	}
 	defer res.Body.Close()
 
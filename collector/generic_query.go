@@ -1,41 +1,763 @@
 package collector
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
-	"strings"
 	"regexp"
+	"sort"
 	"strconv"
-	"io/ioutil"
+	"strings"
 	"sync"
-	"fmt"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"github.com/justwatchcom/elasticsearch_exporter/version"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
 )
 
+// NameResponse is the part of the root endpoint response identifying the
+// cluster. The node count isn't part of it, it is exported by the cluster
+// health collector as number_of_nodes.
 type NameResponse struct {
-	ClusterName     string    `json:"cluster_name"`
-	nodes           string    `json:nodes`
+	ClusterName string `json:"cluster_name"`
+	ClusterUUID string `json:"cluster_uuid"`
+	Version     struct {
+		Number string `json:"number"`
+	} `json:"version"`
 }
 
 type GenericExporter struct {
 	logger          log.Logger
 	client          *http.Client
+	transport       *http.Transport
 	url             *url.URL
 	mutex           sync.RWMutex
-	URI_path        string
-	subsystem       string
+	URI_paths       []string
 	ClusterName     string
+	ClusterUUID     string
+	Namespace       string
+	Username        string
+	Password        string
+	BearerToken     string
+	BearerTokenFile string
+	APIKey          string
+	Headers         map[string]string
+	UserAgent       string
+	CAFile          string
+	CertFile        string
+	KeyFile         string
+
+	InsecureSkipVerify bool
+	Timeout            time.Duration
+	StartupTimeout     time.Duration
+	Retries            int
+	RetryDelay         time.Duration
+	Include            *regexp.Regexp
+	TopLevelKeys       []string
+	Exclude            *regexp.Regexp
+	Debug              bool
+	StringValues       map[string]map[string]float64
+
+	ParseNumericStrings bool
+	ByteUnitBase        float64
+	ParseDurations      bool
+	LabelKeys           map[string]string
+	ArrayLabel          string
+	ArrayLabelKey       string
+	ScalarArrays        string
+	StaticLabels        prometheus.Labels
+	ClusterLabel        string
+	OmitClusterLabel    bool
+	ClusterUUIDLabel    bool
+	Method              string
+	Body                []byte
+	MaxDepth            int
+	MaxSeries           int
+	CacheTTL            time.Duration
+	MaxConcurrency      int
+	Subsystems          map[string]string
+	Help                map[string]string
+	Counters            *regexp.Regexp
+	NodeFilter          string
+	NodeRolesLabel      bool
+	NodeAttributeLabels map[string]string
+	TasksLabel          bool
+	ShardLabels         bool
+	PreserveCase        bool
+	SkipZeros           bool
+	DropHumanReadable   bool
+	DropBools           bool
+	DropNumbers         bool
+	DropStrings         bool
+	Separator           string
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	UnixSocket          string
+	HTTP2               bool
+	StrictClusterName   bool
+	ClusterNameOverride string
+
+	scrapeMutex sync.Mutex
+	ctxMutex    sync.Mutex
+	ctx         context.Context
+
+	tokenMutex  sync.Mutex
+	token       string
+	tokenReadAt time.Time
+
+	clusterNameRetryAt time.Time
+
+	// shardIndexLabel is set if the index label was only enabled because
+	// ShardLabels implies it.
+	shardIndexLabel bool
+
+	paths  []*genericPath
+	closed bool
+
+	// selfMetrics holds the fully qualified names of the self-metrics of
+	// all paths.
+	selfMetrics map[string]bool
+}
+
+// genericPath holds the metrics of one URI path queried by a GenericExporter.
+type genericPath struct {
+	*GenericExporter
+	URI_path  string
+	subsystem string
+
+	gauges                               map[string]*prometheus.GaugeVec
+	counters                             map[string]*prometheus.Desc
+	counterMetrics                       map[string]prometheus.Metric
+	labelNames                           map[string][]string
+	fqNames                              map[string]string
+	seen                                 map[string]bool
+	keys                                 map[string]string
+	cachedAt                             time.Time
+	depthReached                         int
+	parseError                           string
+	lastParseError                       *prometheus.GaugeVec
+	scrapeErrors                         *prometheus.CounterVec
+	upVec                                *prometheus.GaugeVec
+	up, scrapeDuration, clusterInfo      prometheus.Gauge
+	lastScrapeTimestamp, statusCode      prometheus.Gauge
+	responseBytes, seriesCount           prometheus.Gauge
+	registeredGauges                     prometheus.Gauge
+	clusterNameResolved, maxDepthReached prometheus.Gauge
+	totalScrapes, jsonParseFailures      prometheus.Counter
+	unhandledFields                      prometheus.Counter
+	seriesTruncated, responseBytesTotal  prometheus.Counter
+}
+
+// ClusterStatusValues maps the cluster health colors to gauge values. It is
+// applied to "status" fields by default.
+var ClusterStatusValues = map[string]float64{
+	"green":  0,
+	"yellow": 1,
+	"red":    2,
+}
+
+var (
+	byteSizePattern   = regexp.MustCompile(`^([0-9]*\.?[0-9]+)\s*(b|kb|mb|gb|tb|pb)$`)
+	byteUnitExponents = map[string]float64{"b": 0, "kb": 1, "mb": 2, "gb": 3, "tb": 4, "pb": 5}
+	durationPattern   = regexp.MustCompile(`^([0-9]*\.?[0-9]+)(ms|s|m|h|d)$`)
+	durationUnits     = map[string]time.Duration{"ms": time.Millisecond, "s": time.Second, "m": time.Minute, "h": time.Hour, "d": 24 * time.Hour}
+
+	invalidMetricNameChars = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+	validSeparator         = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+	repeatedUnderscores    = regexp.MustCompile(`__+`)
+
+	// validQueryParam matches a query parameter which can be sent as is.
+	validQueryParam = regexp.MustCompile(`^[a-zA-Z0-9\-._~!$'()*+,;=:@/?%]*$`)
+)
+
+// The reasons of failed scrapes counted by the scrape_errors_total metric.
+const (
+	scrapeErrorConnection = "connection"
+	scrapeErrorHTTPStatus = "http_status"
+	scrapeErrorParse      = "parse"
+)
+
+// tokenFileTTL is the time for which a token read from the token file is
+// used before reading the file again.
+const tokenFileTTL = 10 * time.Second
+
+// defaultStartupTimeout is the deadline for querying the cluster name in
+// NewGenericQuery unless set by WithStartupTimeout.
+const defaultStartupTimeout = 10 * time.Second
+
+// clusterNameRetryInterval is the time collects wait after failing to
+// resolve the cluster name before querying the root endpoint again.
+const clusterNameRetryInterval = 30 * time.Second
+
+// maxParseErrorLength is the number of characters of a parse error kept in
+// the label of the last_parse_error metric.
+const maxParseErrorLength = 128
+
+// Option configures optional behaviour of a GenericExporter. Options are
+// applied in the given order before the defaults are filled in and the
+// configuration is validated, so later options override earlier ones.
+type Option func(*GenericExporter)
+
+// WithNamespace sets the Prometheus namespace of all metrics exported for the
+// URI path. An empty namespace falls back to the default "elasticsearch".
+func WithNamespace(ns string) Option {
+	return func(c *GenericExporter) {
+		c.Namespace = ns
+	}
+}
+
+// WithBasicAuth sets the credentials sent with every request to Elasticsearch,
+// including the cluster name lookup.
+func WithBasicAuth(username, password string) Option {
+	return func(c *GenericExporter) {
+		c.Username = username
+		c.Password = password
+	}
+}
+
+// WithBearerToken sets a token sent as "Authorization: Bearer <token>" with
+// every request to Elasticsearch.
+func WithBearerToken(token string) Option {
+	return func(c *GenericExporter) {
+		c.BearerToken = token
+	}
+}
+
+// WithBearerTokenFile reads the bearer token from path, e.g. a token rotated
+// on disk. The file is read again before requests once the last read is
+// older than a few seconds, keeping the last token if that fails.
+func WithBearerTokenFile(path string) Option {
+	return func(c *GenericExporter) {
+		c.BearerTokenFile = path
+	}
+}
+
+// WithAPIKey sets a base64 encoded Elasticsearch API key sent as
+// "Authorization: ApiKey <key>" with every request to Elasticsearch.
+func WithAPIKey(key string) Option {
+	return func(c *GenericExporter) {
+		c.APIKey = key
+	}
+}
+
+// WithHeaders adds the headers to every request to Elasticsearch, e.g.
+// X-Opaque-Id to tag the queries in the task list and slow logs. The
+// authentication options take precedence over an Authorization header.
+func WithHeaders(headers map[string]string) Option {
+	return func(c *GenericExporter) {
+		c.Headers = headers
+	}
+}
+
+// WithUserAgent overrides the User-Agent header of the requests to
+// Elasticsearch, which defaults to elasticsearch_exporter/<version>.
+func WithUserAgent(userAgent string) Option {
+	return func(c *GenericExporter) {
+		c.UserAgent = userAgent
+	}
+}
+
+// WithCAFile sets the path to a PEM encoded CA bundle used to verify the
+// certificate presented by Elasticsearch.
+func WithCAFile(path string) Option {
+	return func(c *GenericExporter) {
+		c.CAFile = path
+	}
+}
+
+// WithClientCert sets the paths to a PEM encoded client certificate and its
+// private key presented to Elasticsearch for mutual TLS.
+func WithClientCert(certFile, keyFile string) Option {
+	return func(c *GenericExporter) {
+		c.CertFile = certFile
+		c.KeyFile = keyFile
+	}
+}
+
+// WithInsecureSkipVerify disables verification of the certificate presented
+// by Elasticsearch. Only meant for development clusters.
+func WithInsecureSkipVerify(skip bool) Option {
+	return func(c *GenericExporter) {
+		c.InsecureSkipVerify = skip
+	}
+}
+
+// WithTimeout sets a deadline for querying the URI path during a scrape.
+// A zero timeout only relies on the timeout of the client.
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *GenericExporter) {
+		c.Timeout = timeout
+	}
+}
+
+// WithStartupTimeout sets the deadline for querying the cluster name in
+// NewGenericQuery, 10s by default, so an unresponsive cluster can't block the
+// startup of the exporter.
+func WithStartupTimeout(timeout time.Duration) Option {
+	return func(c *GenericExporter) {
+		c.StartupTimeout = timeout
+	}
+}
+
+// WithRetries retries querying the URI path up to retries times on connection
+// errors and 5xx responses, doubling the delay between attempts each time.
+func WithRetries(retries int, delay time.Duration) Option {
+	return func(c *GenericExporter) {
+		c.Retries = retries
+		c.RetryDelay = delay
+	}
+}
+
+// WithInclude only exports the flattened metric names matching re.
+func WithInclude(re *regexp.Regexp) Option {
+	return func(c *GenericExporter) {
+		c.Include = re
+	}
+}
+
+// WithExclude drops the flattened metric names matching re. Excludes take
+// precedence over includes.
+func WithExclude(re *regexp.Regexp) Option {
+	return func(c *GenericExporter) {
+		c.Exclude = re
+	}
+}
+
+// WithTopLevelKeys only descends into the listed top level fields of object
+// responses, e.g. indices and nodes of _cluster/stats. All fields are
+// extracted if keys is empty.
+func WithTopLevelKeys(keys []string) Option {
+	return func(c *GenericExporter) {
+		c.TopLevelKeys = keys
+	}
+}
+
+// WithDebug logs the inferred type of every field while flattening the
+// response at debug level.
+func WithDebug(debug bool) Option {
+	return func(c *GenericExporter) {
+		c.Debug = debug
+	}
+}
+
+// WithStringValues exports the string field with the flattened name metric
+// as the gauge value its string maps to. Unmapped strings are ignored and a
+// nil mapping stops exporting the field.
+func WithStringValues(metric string, values map[string]float64) Option {
+	return func(c *GenericExporter) {
+		if values == nil {
+			delete(c.StringValues, metric)
+			return
+		}
+		c.StringValues[metric] = values
+	}
+}
+
+// WithParseNumericStrings exports string fields holding a number, like
+// "42", as gauges.
+func WithParseNumericStrings(parse bool) Option {
+	return func(c *GenericExporter) {
+		c.ParseNumericStrings = parse
+	}
+}
+
+// WithByteUnits exports string fields holding human readable sizes, like
+// "512mb", in bytes. base is the factor between units and must be 1000 or
+// 1024, while 0 disables parsing sizes.
+func WithByteUnits(base float64) Option {
+	return func(c *GenericExporter) {
+		c.ByteUnitBase = base
+	}
+}
+
+// WithParseDurations exports string fields holding time values, like "1.5s",
+// in seconds under the field name suffixed with "_seconds".
+func WithParseDurations(parse bool) Option {
+	return func(c *GenericExporter) {
+		c.ParseDurations = parse
+	}
+}
+
+// WithLabelKey exports the objects nested in the map with the flattened name
+// key under a shared metric name, carrying their keys as values of label
+// instead of flattening them into the names. WithLabelKey("nodes", "node")
+// exports node stats as nodes_jvm_uptime_in_millis{node="<id>"}.
+func WithLabelKey(key, label string) Option {
+	return func(c *GenericExporter) {
+		if c.LabelKeys == nil {
+			c.LabelKeys = make(map[string]string)
+		}
+		c.LabelKeys[key] = label
+	}
+}
+
+// WithIndexLabel exports the per-index stats in the indices map of _stats
+// responses under shared metric names with an index label, e.g.
+// indices_primaries_docs_count{index="<name>"}. WithIndexLabel(false) removes
+// the index label again, a label key of indices set otherwise is kept.
+func WithIndexLabel(enabled bool) Option {
+	return func(c *GenericExporter) {
+		c.shardIndexLabel = false
+		if enabled {
+			WithLabelKey("indices", "index")(c)
+		} else if c.LabelKeys["indices"] == "index" {
+			delete(c.LabelKeys, "indices")
+		}
+	}
+}
+
+// WithShardLabels exports the per-shard stats of e.g. _stats?level=shards
+// responses under shared metric names with index and shard labels, e.g.
+// indices_shards_docs_count{index="<name>",shard="0",primary="true",node="<id>"}.
+// The primary and node labels tell apart the copies of a shard and are taken
+// from their routing. It implies WithIndexLabel, WithShardLabels(false)
+// removes the index label again unless it was enabled by WithIndexLabel.
+func WithShardLabels(enabled bool) Option {
+	return func(c *GenericExporter) {
+		c.ShardLabels = enabled
+		if enabled && c.LabelKeys["indices"] != "index" {
+			WithIndexLabel(true)(c)
+			c.shardIndexLabel = true
+		} else if !enabled && c.shardIndexLabel {
+			WithIndexLabel(false)(c)
+			c.shardIndexLabel = false
+		}
+	}
+}
+
+// WithArrayLabel exports the elements of arrays under a shared metric name,
+// carrying their position as values of label instead of suffixing the names
+// with it. Nested arrays fall back to suffixed names. This also applies to
+// the rows of _cat responses, which are queried as JSON arrays.
+func WithArrayLabel(label string) Option {
+	return func(c *GenericExporter) {
+		c.ArrayLabel = label
+	}
+}
+
+// WithArrayLabelKey exports arrays of objects under a shared metric name like
+// WithArrayLabel, but takes the label value from the field key of each
+// object, falling back to its position. The label is named after key unless
+// WithArrayLabel is set as well.
+func WithArrayLabelKey(key string) Option {
+	return func(c *GenericExporter) {
+		c.ArrayLabelKey = key
+	}
+}
+
+// Modes of exporting arrays holding only numbers, like [1,2,3].
+const (
+	// ScalarArraysIndex exports each element under a name suffixed with its
+	// position, e.g. load_0, load_1. This is the default.
+	ScalarArraysIndex = "index"
+	// ScalarArraysSuffix exports the sum, min, max and count of the elements
+	// under suffixed names, e.g. load_sum and load_count.
+	ScalarArraysSuffix = "suffix"
+	// ScalarArraysLabel exports the sum, min, max and count of the elements
+	// under the name of the array with a stat label, e.g. load{stat="sum"}.
+	ScalarArraysLabel = "label"
+)
+
+// WithScalarArrays sets how arrays holding only numbers are exported, one of
+// ScalarArraysIndex, ScalarArraysSuffix or ScalarArraysLabel.
+func WithScalarArrays(mode string) Option {
+	return func(c *GenericExporter) {
+		c.ScalarArrays = mode
+	}
+}
+
+// WithStaticLabels adds the constant labels to every metric exported from the
+// response.
+func WithStaticLabels(labels map[string]string) Option {
+	return func(c *GenericExporter) {
+		c.StaticLabels = labels
+	}
+}
+
+// WithClusterLabel sets the name of the label carrying the cluster name,
+// "cluster" by default.
+func WithClusterLabel(label string) Option {
+	return func(c *GenericExporter) {
+		c.ClusterLabel = label
+	}
+}
+
+// WithOmitClusterLabel drops the cluster label from the metrics exported from
+// the response, e.g. in single cluster deployments where it is redundant. The
+// cluster_info metric keeps it.
+func WithOmitClusterLabel(omit bool) Option {
+	return func(c *GenericExporter) {
+		c.OmitClusterLabel = omit
+	}
+}
+
+// WithClusterUUIDLabel adds the uuid of the cluster as "cluster_uuid" label
+// to every metric exported from the response.
+func WithClusterUUIDLabel(enabled bool) Option {
+	return func(c *GenericExporter) {
+		c.ClusterUUIDLabel = enabled
+	}
+}
+
+// WithBody sends body as JSON payload when querying the URI path, e.g. to
+// reach _search aggregations. The request method defaults to POST then.
+func WithBody(body []byte) Option {
+	return func(c *GenericExporter) {
+		c.Body = body
+	}
+}
+
+// WithMethod sets the HTTP method used for querying the URI path.
+func WithMethod(method string) Option {
+	return func(c *GenericExporter) {
+		c.Method = method
+	}
+}
+
+// WithSeparator joins the keys of nested fields with separator instead of a
+// single underscore, e.g. "__" keeps jvm__mem_heap apart from jvm_mem__heap.
+// Include, Exclude and the other name based options match the names joined
+// with it.
+func WithSeparator(separator string) Option {
+	return func(c *GenericExporter) {
+		c.Separator = separator
+	}
+}
+
+// WithMaxDepth stops flattening responses at the given nesting depth, where
+// the top level fields have a depth of 1. Deeper fields are dropped, 0 means
+// unlimited.
+func WithMaxDepth(depth int) Option {
+	return func(c *GenericExporter) {
+		c.MaxDepth = depth
+	}
+}
+
+// WithMaxSeries limits the number of distinct metric names exported per scrape
+// of a URI path. Further metrics are dropped and counted by the
+// series_truncated metric, 0 means unlimited.
+func WithMaxSeries(n int) Option {
+	return func(c *GenericExporter) {
+		c.MaxSeries = n
+	}
+}
+
+// WithCacheTTL reuses the metrics of the last successful scrape of a URI path
+// for ttl instead of querying it again, to protect the cluster from frequent
+// scrapes, e.g. by several Prometheus replicas.
+func WithCacheTTL(ttl time.Duration) Option {
+	return func(c *GenericExporter) {
+		c.CacheTTL = ttl
+	}
+}
+
+// WithMaxConcurrency queries up to n URI paths in parallel during a scrape.
+// By default they are queried one after another.
+func WithMaxConcurrency(n int) Option {
+	return func(c *GenericExporter) {
+		c.MaxConcurrency = n
+	}
+}
+
+// WithSubsystem uses subsystem verbatim for the metrics of URI_path instead of
+// deriving it from the path with GetSubsystem, e.g. to tell apart several
+// exporters querying _nodes/stats.
+func WithSubsystem(URI_path, subsystem string) Option {
+	return func(c *GenericExporter) {
+		if c.Subsystems == nil {
+			c.Subsystems = make(map[string]string)
+		}
+		c.Subsystems[URI_path] = subsystem
+	}
+}
+
+// WithHelp sets the help texts of metrics by their sanitized flattened name,
+// e.g. "number_of_nodes". Metrics without a help text are described by their
+// name.
+func WithHelp(help map[string]string) Option {
+	return func(c *GenericExporter) {
+		c.Help = help
+	}
+}
+
+// WithCounters exports the metrics whose sanitized flattened names match re,
+// like indexing_index_total, as counters instead of gauges.
+func WithCounters(re *regexp.Regexp) Option {
+	return func(c *GenericExporter) {
+		c.Counters = re
+	}
+}
+
+// WithNodeFilter only exports the stats of the node with the given id or name
+// from the nodes map of e.g. _nodes/stats responses.
+func WithNodeFilter(node string) Option {
+	return func(c *GenericExporter) {
+		c.NodeFilter = node
+	}
+}
+
+// WithNodeRolesLabel attaches the sorted, comma separated roles of each node
+// in the nodes map of e.g. _nodes/stats responses as roles label to the
+// metrics of the node, e.g. to tell apart master eligible and data nodes.
+func WithNodeRolesLabel(enabled bool) Option {
+	return func(c *GenericExporter) {
+		c.NodeRolesLabel = enabled
+	}
+}
+
+// WithNodeAttributeLabel attaches the value of the given node attribute, e.g.
+// box_type, as label to the metrics of each node in the nodes map. Nodes
+// without the attribute get an empty value.
+func WithNodeAttributeLabel(attribute, label string) Option {
+	return func(c *GenericExporter) {
+		if c.NodeAttributeLabels == nil {
+			c.NodeAttributeLabels = make(map[string]string)
+		}
+		c.NodeAttributeLabels[attribute] = label
+	}
+}
+
+// WithTasksLabel exports the running tasks in the tasks maps of _tasks
+// responses under shared metric names with the task id as task label, e.g.
+// tasks_running_time_in_nanos{task="<node>:<id>",action="<action>",node="<node>"},
+// instead of flattening the ids into the names. This holds for the tasks
+// grouped by node as well.
+func WithTasksLabel(enabled bool) Option {
+	return func(c *GenericExporter) {
+		c.TasksLabel = enabled
+	}
+}
+
+// WithPreserveCase keeps the case of the flattened keys in metric names, e.g.
+// to tell apart keys only differing in case. They are lower-cased by default.
+func WithPreserveCase(preserve bool) Option {
+	return func(c *GenericExporter) {
+		c.PreserveCase = preserve
+	}
+}
+
+// WithSkipZeros drops values which are exactly 0. It is opt-in since 0 is
+// meaningful for many fields, e.g. relocating_shards.
+func WithSkipZeros(skip bool) Option {
+	return func(c *GenericExporter) {
+		c.SkipZeros = skip
+	}
+}
+
+// WithDropHumanReadable drops string fields like "heap_used":"1.2gb" if the
+// same object has the raw value as sibling with an _in_bytes or _in_millis
+// suffix, e.g. when WithByteUnits or WithParseDurations would export both.
+func WithDropHumanReadable(drop bool) Option {
+	return func(c *GenericExporter) {
+		c.DropHumanReadable = drop
+	}
+}
+
+// WithDropBools drops boolean fields, which are exported as 1 or 0 otherwise.
+func WithDropBools(drop bool) Option {
+	return func(c *GenericExporter) {
+		c.DropBools = drop
+	}
+}
+
+// WithDropNumbers drops numeric fields, e.g. to only export the values of
+// string fields mapped by WithStringValues.
+func WithDropNumbers(drop bool) Option {
+	return func(c *GenericExporter) {
+		c.DropNumbers = drop
+	}
+}
+
+// WithDropStrings drops string fields which would be exported as mapped or
+// parsed values otherwise, like the cluster health status.
+func WithDropStrings(drop bool) Option {
+	return func(c *GenericExporter) {
+		c.DropStrings = drop
+	}
+}
 
-	gauges                          map[string]*prometheus.GaugeVec
-	up                              prometheus.Gauge
-	totalScrapes, jsonParseFailures prometheus.Counter
+// WithMaxIdleConns sets the maximum number of idle keep-alive connections of
+// the transport, 0 keeps the setting of the given client.
+func WithMaxIdleConns(n int) Option {
+	return func(c *GenericExporter) {
+		c.MaxIdleConns = n
+	}
+}
+
+// WithMaxIdleConnsPerHost sets the maximum number of idle keep-alive
+// connections to the cluster, 0 keeps the setting of the given client.
+func WithMaxIdleConnsPerHost(n int) Option {
+	return func(c *GenericExporter) {
+		c.MaxIdleConnsPerHost = n
+	}
+}
+
+// WithIdleConnTimeout sets how long idle keep-alive connections are kept
+// open, 0 keeps the setting of the given client.
+func WithIdleConnTimeout(timeout time.Duration) Option {
+	return func(c *GenericExporter) {
+		c.IdleConnTimeout = timeout
+	}
+}
+
+// WithUnixSocket connects to Elasticsearch through the Unix domain socket at
+// path, e.g. of a local agent in front of it. The host of the URL is ignored
+// then. Passing a unix:///path/to/socket URL to NewGenericQuery does the same.
+func WithUnixSocket(path string) Option {
+	return func(c *GenericExporter) {
+		c.UnixSocket = path
+	}
+}
+
+// WithHTTP2 attempts HTTP/2 on TLS connections to Elasticsearch even if the
+// transport of the client has a custom TLS or dial configuration, which makes
+// the standard library fall back to HTTP/1.1. Plain HTTP stays on HTTP/1.1.
+func WithHTTP2(enabled bool) Option {
+	return func(c *GenericExporter) {
+		c.HTTP2 = enabled
+	}
+}
+
+// WithStrictClusterName makes NewGenericQuery fail if the cluster name can't
+// be fetched instead of exporting metrics with an empty cluster label.
+func WithStrictClusterName(strict bool) Option {
+	return func(c *GenericExporter) {
+		c.StrictClusterName = strict
+	}
 }
 
+// WithClusterNameOverride uses name as cluster name instead of querying it
+// from the root endpoint, e.g. if that is blocked.
+func WithClusterNameOverride(name string) Option {
+	return func(c *GenericExporter) {
+		c.ClusterNameOverride = name
+	}
+}
+
+// GetSubsystem derives the subsystem of the metrics of URI_path from its
+// segments, ignoring any query string and trailing slash.
 func GetSubsystem(URI_path string) string {
+	if i := strings.Index(URI_path, "?"); i >= 0 {
+		URI_path = URI_path[:i]
+	}
+	URI_path = strings.TrimRight(URI_path, "/")
+
 	strip_leading_slash := regexp.MustCompile("^/?_?([^/_]+)")
 	convert_slash_to_underscore := regexp.MustCompile("/_?([^/])")
 
@@ -45,318 +767,2057 @@ func GetSubsystem(URI_path string) string {
 	return subsystem
 }
 
-func GetClusterName(logger log.Logger, client *http.Client, url *url.URL) (string, error) {
-	url.Path = ""
-	var name_response NameResponse
-	resp, err := client.Get(url.String())
-	if err != nil {
-		return "", fmt.Errorf("Failed to get Cluster Name from %s://%s:%s/%s: %s",
-		url.Scheme, url.Hostname(), url.Port(), url.Path, err)
+// tlsConfig returns the TLS configuration requested through the options, or
+// nil if the transport of the given client should be used unchanged.
+func (c *GenericExporter) tlsConfig() (*tls.Config, error) {
+	if c.CAFile == "" && c.CertFile == "" && c.KeyFile == "" && !c.InsecureSkipVerify {
+		return nil, nil
+	}
+	config := &tls.Config{
+		InsecureSkipVerify: c.InsecureSkipVerify,
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("HTTP Request failed with code %d", resp.StatusCode)
+	if c.CAFile != "" {
+		caCert, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file %s: %w", c.CAFile, err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", c.CAFile)
+		}
 	}
 
-	if err := json.NewDecoder(resp.Body).Decode(&name_response); err != nil {
-		return "", fmt.Errorf("Failed to Parse JSON response", err)
+	if c.CertFile != "" || c.KeyFile != "" {
+		if c.CertFile == "" || c.KeyFile == "" {
+			return nil, fmt.Errorf("both a client certificate and key are required for mutual TLS")
+		}
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate %s and key %s: %w", c.CertFile, c.KeyFile, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
 	}
 
-	return name_response.ClusterName, nil
+	return config, nil
+}
+
+// UnixSocketDialer returns a DialContext function for http.Transport which
+// connects to the Unix domain socket at path, whatever address is requested.
+func UnixSocketDialer(path string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	return func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "unix", path)
+	}
 }
 
-func NewGenericQuery(logger log.Logger, client *http.Client, url *url.URL, URI_path string) *GenericExporter {
-	ClusterName, err := GetClusterName(logger, client, url)
+// configureTransport replaces the client with a copy whose transport carries
+// the configured TLS and connection pool settings, leaving the shared client
+// untouched.
+func (c *GenericExporter) configureTransport() error {
+	tlsConfig, err := c.tlsConfig()
 	if err != nil {
-		level.Warn(logger).Log(
-			"msg", "Failed to fetch and decode Cluster Name",
-			"err", err,
-		)
+		return err
+	}
+	if tlsConfig == nil && c.MaxIdleConns == 0 && c.MaxIdleConnsPerHost == 0 && c.IdleConnTimeout == 0 && c.UnixSocket == "" && !c.HTTP2 {
+		return nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if t, ok := c.client.Transport.(*http.Transport); ok {
+		transport = t.Clone()
+	}
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+	if c.MaxIdleConns > 0 {
+		transport.MaxIdleConns = c.MaxIdleConns
+	}
+	if c.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = c.MaxIdleConnsPerHost
+	}
+	if c.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = c.IdleConnTimeout
+	}
+	if c.UnixSocket != "" {
+		transport.DialContext = UnixSocketDialer(c.UnixSocket)
+	}
+
+	if c.HTTP2 {
+		transport.ForceAttemptHTTP2 = true
 	}
 
-	subsystem := GetSubsystem(URI_path)
-	gauges := make(map[string]*prometheus.GaugeVec)
+	client := *c.client
+	client.Transport = transport
+	c.client = &client
+	c.transport = transport
 
-	exporter := GenericExporter{
-		logger: logger,
-		client: client,
-		url:    url,
-		URI_path: URI_path,
-		subsystem: subsystem,
-		ClusterName: ClusterName,
+	return nil
+}
+
+// newRequest builds a request for u carrying the configured credentials. A
+// non-nil body is sent as JSON.
+func (c *GenericExporter) newRequest(ctx context.Context, method string, u *url.URL, body []byte) (*http.Request, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", c.userAgent())
+	for name, value := range c.Headers {
+		req.Header.Set(name, value)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Username != "" || c.Password != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+	if token := c.bearerToken(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if c.APIKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+c.APIKey)
+	}
+	return req, nil
+}
+
+// userAgent returns the configured User-Agent or one naming the exporter and
+// its version, so its load can be told apart in the audit logs.
+func (c *GenericExporter) userAgent() string {
+	if c.UserAgent != "" {
+		return c.UserAgent
+	}
+	if version.Version == "" {
+		return "elasticsearch_exporter"
+	}
+	return "elasticsearch_exporter/" + version.Version
+}
 
-		gauges: gauges,
+// bearerToken returns the configured bearer token or the one read last from
+// the token file, reading it again if it is outdated.
+func (c *GenericExporter) bearerToken() string {
+	if c.BearerTokenFile == "" {
+		return c.BearerToken
+	}
+	c.tokenMutex.Lock()
+	defer c.tokenMutex.Unlock()
 
-		up: prometheus.NewGauge(prometheus.GaugeOpts{
-			Name: prometheus.BuildFQName(namespace, subsystem, "up"),
-			Help: "Was the last scrape of the ElasticSearch cluster health endpoint successful.",
-		}),
-		totalScrapes: prometheus.NewCounter(prometheus.CounterOpts{
-			Name: prometheus.BuildFQName(namespace, subsystem, "total_scrapes"),
-			Help: "Current total ElasticSearch cluster health scrapes.",
-		}),
-		jsonParseFailures: prometheus.NewCounter(prometheus.CounterOpts{
-			Name: prometheus.BuildFQName(namespace, subsystem, "json_parse_failures"),
-			Help: "Number of errors while parsing JSON.",
-		}),
+	if time.Since(c.tokenReadAt) < tokenFileTTL {
+		return c.token
 	}
+	c.tokenReadAt = time.Now()
+	token, err := readTokenFile(c.BearerTokenFile)
+	if err != nil {
+		level.Warn(c.logger).Log(
+			"msg", "Failed to read the bearer token file, keeping the last token",
+			"file", c.BearerTokenFile,
+			"err", err,
+		)
+		return c.token
+	}
+	c.token = token
+	return c.token
+}
+
+// readTokenFile returns the token stored in the file at path.
+func readTokenFile(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", fmt.Errorf("empty token file %s", path)
+	}
+	return token, nil
+}
+
+// do queries u, retrying connection errors and 5xx responses with exponential
+// backoff as configured. The response body may be gzip compressed, see
+// responseBody.
+func (c *GenericExporter) do(ctx context.Context, method string, u *url.URL, body []byte) (*http.Response, error) {
+	delay := c.RetryDelay
+	for attempt := 0; ; attempt++ {
+		req, err := c.newRequest(ctx, method, u, body)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp, err := c.client.Do(req)
+		if (err == nil && resp.StatusCode < 500) || attempt >= c.Retries {
+			return resp, err
+		}
+		if err == nil {
+			resp.Body.Close()
+			err = fmt.Errorf("HTTP Request failed with code %d", resp.StatusCode)
+		}
+		level.Debug(c.logger).Log(
+			"msg", "Retrying Json endpoint query.",
+			"url", u.Redacted(),
+			"attempt", attempt+1,
+			"delay", delay,
+			"err", err,
+		)
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// responseBody returns the body of resp, decompressing it if gzip encoded.
+// Closing it closes the body of resp as well.
+func responseBody(resp *http.Response) (io.ReadCloser, error) {
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		return resp.Body, nil
+	}
+	reader, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return gzipBody{Reader: reader, body: resp.Body}, nil
+}
+
+// gzipBody is a decompressed response body.
+type gzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+// Close closes the gzip reader and the underlying body.
+func (b gzipBody) Close() error {
+	err := b.Reader.Close()
+	if bodyErr := b.body.Close(); err == nil {
+		err = bodyErr
+	}
+	return err
+}
+
+// fetchClusterInfo queries the cluster name and uuid from the root endpoint,
+// retrying and timing out like the queries of the URI paths. A configured
+// ClusterNameOverride is returned without querying the cluster.
+func (c *GenericExporter) fetchClusterInfo(ctx context.Context, timeout time.Duration) (NameResponse, error) {
+	if c.ClusterNameOverride != "" {
+		return NameResponse{ClusterName: c.ClusterNameOverride}, nil
+	}
+	url := *c.url
+	url.Path = ""
+	url.RawPath = ""
+	url.RawQuery = ""
+	var name_response NameResponse
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	resp, err := c.do(ctx, "GET", &url, nil)
+	if err != nil {
+		return name_response, fmt.Errorf("Failed to get Cluster Name from %s: %w", url.Redacted(), err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return name_response, fmt.Errorf("HTTP Request failed with code %d", resp.StatusCode)
+	}
+
+	body, err := responseBody(resp)
+	if err != nil {
+		return name_response, fmt.Errorf("Failed to decompress JSON response from %s: %w", url.Redacted(), err)
+	}
+	defer body.Close()
+	if err := json.NewDecoder(body).Decode(&name_response); err != nil {
+		return name_response, fmt.Errorf("Failed to Parse JSON response from %s: %w", url.Redacted(), err)
+	}
+
+	return name_response, nil
+}
+
+// GetClusterName queries the cluster name from the root endpoint.
+func (c *GenericExporter) GetClusterName() (string, error) {
+	info, err := c.fetchClusterInfo(c.context(), c.Timeout)
+	return info.ClusterName, err
+}
+
+// validLabelName reports whether name can be used as label name next to the
+// cluster label. Names starting with __ are reserved for Prometheus.
+func (c *GenericExporter) validLabelName(name string) bool {
+	if c.ClusterUUIDLabel && name == "cluster_uuid" {
+		return false
+	}
+	return model.LabelName(name).IsValid() && !strings.HasPrefix(name, "__") && name != c.ClusterLabel
+}
+
+// labelConflict returns what the label name added while extracting metrics
+// conflicts with among the label keys, static labels and the array label, or
+// an empty string if it doesn't conflict.
+func (c *GenericExporter) labelConflict(name string) string {
+	for _, l := range c.LabelKeys {
+		if l == name {
+			return "the label of a label key"
+		}
+	}
+	if _, ok := c.StaticLabels[name]; ok {
+		return "a static label"
+	}
+	if name == c.ArrayLabel || (c.ArrayLabel == "" && name == c.ArrayLabelKey) {
+		return "the array label"
+	}
+	return ""
+}
+
+// validateLabels checks the names of the labels added to the metrics of what
+// against the cluster label and labelConflict. A label key may add the node
+// label itself, the node label is kept then.
+func (c *GenericExporter) validateLabels(what string, names ...string) error {
+	for _, name := range names {
+		conflict := c.labelConflict(name)
+		if name == "node" {
+			for _, l := range c.LabelKeys {
+				if l == name {
+					conflict = ""
+				}
+			}
+		}
+		if !c.validLabelName(name) {
+			conflict = "the cluster label"
+		}
+		if conflict != "" {
+			return fmt.Errorf("the %s label of %s conflicts with %s", name, what, conflict)
+		}
+	}
+	return nil
+}
+
+// validate checks the consistency of the configured options.
+func (c *GenericExporter) validate() error {
+	if !model.LabelName(c.ClusterLabel).IsValid() || strings.HasPrefix(c.ClusterLabel, "__") || (c.ClusterUUIDLabel && c.ClusterLabel == "cluster_uuid") {
+		return fmt.Errorf("invalid cluster label name %q", c.ClusterLabel)
+	}
+	if c.ClusterLabel == "uuid" || c.ClusterLabel == "version" {
+		return fmt.Errorf("cluster label %q conflicts with a label of cluster_info", c.ClusterLabel)
+	}
+	if !validSeparator.MatchString(c.Separator) {
+		return fmt.Errorf("invalid separator %q, only letters, digits and underscores are allowed", c.Separator)
+	}
+	if c.Retries < 0 || c.RetryDelay < 0 {
+		return fmt.Errorf("retries and retry delay must not be negative")
+	}
+	if c.MaxDepth < 0 {
+		return fmt.Errorf("max depth must not be negative, got %d", c.MaxDepth)
+	}
+	if c.MaxIdleConns < 0 || c.MaxIdleConnsPerHost < 0 || c.IdleConnTimeout < 0 {
+		return fmt.Errorf("connection pool settings must not be negative")
+	}
+	if c.MaxSeries < 0 {
+		return fmt.Errorf("max series must not be negative, got %d", c.MaxSeries)
+	}
+	if c.MaxConcurrency < 0 {
+		return fmt.Errorf("max concurrency must not be negative, got %d", c.MaxConcurrency)
+	}
+	if c.StartupTimeout < 0 {
+		return fmt.Errorf("startup timeout must not be negative, got %s", c.StartupTimeout)
+	}
+	if c.ByteUnitBase != 0 && c.ByteUnitBase != 1000 && c.ByteUnitBase != 1024 {
+		return fmt.Errorf("byte unit base must be 1000 or 1024, got %v", c.ByteUnitBase)
+	}
+	if label := c.ArrayLabel; label != "" && !c.validLabelName(label) {
+		return fmt.Errorf("invalid array label name %q", label)
+	}
+	if label := c.ArrayLabelKey; c.ArrayLabel == "" && label != "" && !c.validLabelName(label) {
+		return fmt.Errorf("invalid array label name %q", label)
+	}
+	switch c.ScalarArrays {
+	case ScalarArraysIndex, ScalarArraysSuffix:
+	case ScalarArraysLabel:
+		if err := c.validateLabels("scalar arrays", "stat"); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid scalar arrays mode %q", c.ScalarArrays)
+	}
+	if c.TasksLabel {
+		if err := c.validateLabels("tasks", "task", "action", "node"); err != nil {
+			return err
+		}
+	}
+	if c.ShardLabels {
+		if err := c.validateLabels("shards", "shard", "primary", "node"); err != nil {
+			return err
+		}
+	}
+	keyLabels := make(map[string]string, len(c.LabelKeys))
+	for key, label := range c.LabelKeys {
+		if !c.validLabelName(label) {
+			return fmt.Errorf("invalid label name %q for key %s", label, key)
+		}
+		if other, ok := keyLabels[label]; ok {
+			return fmt.Errorf("label keys %s and %s share the label %q", other, key, label)
+		}
+		keyLabels[label] = key
+	}
+	arrayLabel := c.ArrayLabel
+	if arrayLabel == "" {
+		arrayLabel = c.ArrayLabelKey
+	}
+	if key, ok := keyLabels[arrayLabel]; ok && arrayLabel != "" {
+		return fmt.Errorf("array label %q conflicts with the label of the label key %s", arrayLabel, key)
+	}
+	if c.NodeRolesLabel {
+		if conflict := c.labelConflict("roles"); conflict != "" {
+			return fmt.Errorf("the roles label of nodes conflicts with %s", conflict)
+		}
+	}
+	attributeLabels := make(map[string]string, len(c.NodeAttributeLabels))
+	for attribute, label := range c.NodeAttributeLabels {
+		if !c.validLabelName(label) || (c.NodeRolesLabel && label == "roles") {
+			return fmt.Errorf("invalid label name %q for node attribute %s", label, attribute)
+		}
+		if conflict := c.labelConflict(label); conflict != "" {
+			return fmt.Errorf("label %q for node attribute %s conflicts with %s", label, attribute, conflict)
+		}
+		if other, ok := attributeLabels[label]; ok {
+			return fmt.Errorf("node attributes %s and %s share the label %q", other, attribute, label)
+		}
+		attributeLabels[label] = attribute
+	}
+	for label := range c.StaticLabels {
+		if !c.validLabelName(label) {
+			return fmt.Errorf("invalid static label name %q", label)
+		}
+		for _, l := range c.LabelKeys {
+			if l == label {
+				return fmt.Errorf("static label %q conflicts with the label of a label key", label)
+			}
+		}
+		if label == c.ArrayLabel || (c.ArrayLabel == "" && label == c.ArrayLabelKey) {
+			return fmt.Errorf("static label %q conflicts with the array label", label)
+		}
+	}
+	if c.APIKey != "" {
+		if c.Username != "" || c.Password != "" {
+			return fmt.Errorf("API key and basic auth are mutually exclusive")
+		}
+		if c.BearerToken != "" || c.BearerTokenFile != "" {
+			return fmt.Errorf("API key and bearer token are mutually exclusive")
+		}
+	}
+	if c.BearerToken != "" && c.BearerTokenFile != "" {
+		return fmt.Errorf("bearer token and bearer token file are mutually exclusive")
+	}
+	if (c.BearerToken != "" || c.BearerTokenFile != "") && (c.Username != "" || c.Password != "") {
+		return fmt.Errorf("bearer token and basic auth are mutually exclusive")
+	}
+	return nil
+}
+
+// Config configures a GenericExporter created by NewGenericQueryConfig. The
+// common settings have fields of their own, zero values keep the defaults.
+// All other settings are passed as Options, which are applied after the
+// fields and so take precedence over them.
+type Config struct {
+	// Logger receives the warnings and debug output of the exporter.
+	Logger log.Logger
+	// Client sends the requests. It is copied, not modified, if the
+	// options need a transport of their own.
+	Client *http.Client
+	// URL is the address of the cluster, a unix:// URL connects to the
+	// socket at its path.
+	URL *url.URL
+	// URIPaths are the endpoints queried, relative to URL.
+	URIPaths []string
+
+	// Namespace is the prefix of the metric names, see WithNamespace.
+	Namespace string
+	// Username and Password are sent as basic auth, see WithBasicAuth.
+	Username string
+	Password string
+	// APIKey is sent as ApiKey authorization, see WithAPIKey.
+	APIKey string
+	// BearerToken is sent as bearer authorization, see WithBearerToken.
+	BearerToken string
+	// Headers are added to every request, see WithHeaders.
+	Headers map[string]string
+	// Timeout bounds each query, see WithTimeout.
+	Timeout time.Duration
+	// Retries and RetryDelay retry failed queries, see WithRetries.
+	Retries    int
+	RetryDelay time.Duration
+	// ClusterLabel names the label carrying the cluster name, see
+	// WithClusterLabel.
+	ClusterLabel string
+	// StaticLabels are added to every metric, see WithStaticLabels.
+	StaticLabels map[string]string
+
+	// Options are applied in order, later ones take precedence.
+	Options []Option
+}
+
+// options returns the options setting the non-zero fields of cfg, followed
+// by cfg.Options.
+func (cfg Config) options() []Option {
+	var opts []Option
+	if cfg.Namespace != "" {
+		opts = append(opts, WithNamespace(cfg.Namespace))
+	}
+	if cfg.Username != "" || cfg.Password != "" {
+		opts = append(opts, WithBasicAuth(cfg.Username, cfg.Password))
+	}
+	if cfg.APIKey != "" {
+		opts = append(opts, WithAPIKey(cfg.APIKey))
+	}
+	if cfg.BearerToken != "" {
+		opts = append(opts, WithBearerToken(cfg.BearerToken))
+	}
+	if cfg.Headers != nil {
+		opts = append(opts, WithHeaders(cfg.Headers))
+	}
+	if cfg.Timeout != 0 {
+		opts = append(opts, WithTimeout(cfg.Timeout))
+	}
+	if cfg.Retries != 0 || cfg.RetryDelay != 0 {
+		opts = append(opts, WithRetries(cfg.Retries, cfg.RetryDelay))
+	}
+	if cfg.ClusterLabel != "" {
+		opts = append(opts, WithClusterLabel(cfg.ClusterLabel))
+	}
+	if cfg.StaticLabels != nil {
+		opts = append(opts, WithStaticLabels(cfg.StaticLabels))
+	}
+	return append(opts, cfg.Options...)
+}
+
+// NewGenericQuery creates a GenericExporter querying the given URI paths of
+// the cluster at url. It is a shorthand for NewGenericQueryConfig.
+func NewGenericQuery(logger log.Logger, client *http.Client, url *url.URL, URI_paths []string, opts ...Option) (*GenericExporter, error) {
+	return NewGenericQueryConfig(Config{
+		Logger:   logger,
+		Client:   client,
+		URL:      url,
+		URIPaths: URI_paths,
+		Options:  opts,
+	})
+}
+
+// NewGenericQueryConfig creates a GenericExporter from cfg, querying the
+// cluster name once unless it is overridden.
+func NewGenericQueryConfig(cfg Config) (*GenericExporter, error) {
+	URI_paths := cfg.URIPaths
+	exporter := GenericExporter{
+		logger:    cfg.Logger,
+		client:    cfg.Client,
+		url:       cfg.URL,
+		URI_paths: URI_paths,
+
+		StringValues: map[string]map[string]float64{
+			"status": ClusterStatusValues,
+		},
+	}
+	for _, opt := range cfg.options() {
+		opt(&exporter)
+	}
+	if exporter.url != nil && exporter.url.Scheme == "unix" {
+		exporter.UnixSocket = exporter.url.Path
+		exporter.url = &url.URL{Scheme: "http", Host: "localhost"}
+	}
+	if exporter.Namespace == "" {
+		exporter.Namespace = namespace
+	}
+	if exporter.ClusterLabel == "" {
+		exporter.ClusterLabel = "cluster"
+	}
+	if exporter.Separator == "" {
+		exporter.Separator = "_"
+	}
+	if exporter.StartupTimeout == 0 {
+		exporter.StartupTimeout = defaultStartupTimeout
+	}
+	if exporter.ScalarArrays == "" {
+		exporter.ScalarArrays = ScalarArraysIndex
+	}
+	if exporter.Method == "" {
+		exporter.Method = "GET"
+		if exporter.Body != nil {
+			exporter.Method = "POST"
+		}
+	}
+	if len(URI_paths) == 0 {
+		return nil, fmt.Errorf("at least one URI path is required")
+	}
+	for _, URI_path := range URI_paths {
+		if err := exporter.validatePath(URI_path); err != nil {
+			return nil, err
+		}
+	}
+	if err := exporter.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := exporter.configureTransport(); err != nil {
+		return nil, err
+	}
+	if exporter.BearerTokenFile != "" {
+		token, err := readTokenFile(exporter.BearerTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the bearer token file: %w", err)
+		}
+		exporter.token, exporter.tokenReadAt = token, time.Now()
+	}
+	if exporter.InsecureSkipVerify {
+		level.Warn(exporter.logger).Log(
+			"msg", "TLS certificate verification is disabled, do not use this in production",
+			"paths", strings.Join(URI_paths, ","),
+		)
+	}
+
+	info, err := exporter.fetchClusterInfo(context.Background(), exporter.StartupTimeout)
+	if err == nil && info.ClusterName == "" {
+		err = fmt.Errorf("empty cluster name")
+	}
+	if err != nil {
+		if exporter.StrictClusterName {
+			return nil, fmt.Errorf("failed to fetch the cluster name: %w", err)
+		}
+		level.Error(exporter.logger).Log(
+			"msg", "Failed to fetch and decode Cluster Name",
+			"err", err,
+		)
+	}
+	exporter.ClusterName = info.ClusterName
+	exporter.ClusterUUID = info.ClusterUUID
+
+	subsystems := make(map[string]string)
+	exporter.selfMetrics = make(map[string]bool)
+	for _, URI_path := range URI_paths {
+		path := exporter.newPath(URI_path, info)
+		if other, ok := subsystems[path.subsystem]; ok {
+			return nil, fmt.Errorf("URI paths %s and %s share the subsystem %s", other, URI_path, path.subsystem)
+		}
+		subsystems[path.subsystem] = URI_path
+		exporter.paths = append(exporter.paths, path)
+		for name := range selfMetricNames {
+			exporter.selfMetrics[prometheus.BuildFQName(exporter.Namespace, path.subsystem, name)] = true
+		}
+	}
+
+	return &exporter, nil
+}
+
+// subsystem returns the configured or derived subsystem of the metrics of
+// URI_path.
+func (c *GenericExporter) subsystem(URI_path string) string {
+	if subsystem := c.Subsystems[URI_path]; subsystem != "" {
+		return subsystem
+	}
+	return GetSubsystem(URI_path)
+}
+
+// validatePath checks that URI_path is set, has a valid query string and
+// yields valid metric names.
+func (c *GenericExporter) validatePath(URI_path string) error {
+	path, rawQuery := splitPath(URI_path)
+	if strings.Trim(path, "/ ") == "" {
+		return fmt.Errorf("empty URI path %q", URI_path)
+	}
+	if _, err := url.ParseQuery(rawQuery); err != nil {
+		return fmt.Errorf("invalid query string of URI path %s: %w", URI_path, err)
+	}
+	subsystem := c.subsystem(URI_path)
+	if !model.IsValidMetricName(model.LabelValue(prometheus.BuildFQName(c.Namespace, subsystem, "up"))) {
+		return fmt.Errorf("URI path %s yields the invalid subsystem %q, set one explicitly", URI_path, subsystem)
+	}
+	return nil
+}
+
+// newPath creates the self-metrics of URI_path.
+func (c *GenericExporter) newPath(URI_path string, info NameResponse) *genericPath {
+	path := &genericPath{
+		GenericExporter: c,
+		URI_path:        URI_path,
+		subsystem:       c.subsystem(URI_path),
+
+		gauges:     make(map[string]*prometheus.GaugeVec),
+		counters:   make(map[string]*prometheus.Desc),
+		labelNames: make(map[string][]string),
+		fqNames:    make(map[string]string),
+	}
+
+	path.upVec = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: prometheus.BuildFQName(c.Namespace, path.subsystem, "up"),
+		Help: fmt.Sprintf("Was the last scrape of %s successful.", URI_path),
+	}, []string{"path", "subsystem"})
+	path.up = path.upVec.WithLabelValues(URI_path, path.subsystem)
+	path.totalScrapes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(c.Namespace, path.subsystem, "total_scrapes"),
+		Help: fmt.Sprintf("Current total scrapes of %s.", URI_path),
+	})
+	path.scrapeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(c.Namespace, path.subsystem, "scrape_errors_total"),
+		Help: fmt.Sprintf("Number of failed scrapes of %s by reason.", URI_path),
+	}, []string{"reason"})
+	for _, reason := range []string{scrapeErrorConnection, scrapeErrorHTTPStatus, scrapeErrorParse} {
+		path.scrapeErrors.WithLabelValues(reason)
+	}
+	path.jsonParseFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(c.Namespace, path.subsystem, "json_parse_failures"),
+		Help: fmt.Sprintf("Number of errors while parsing the JSON responses of %s.", URI_path),
+	})
+	path.unhandledFields = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(c.Namespace, path.subsystem, "unhandled_fields"),
+		Help: "Number of fields dropped because of their type, e.g. null values.",
+	})
+	path.seriesTruncated = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(c.Namespace, path.subsystem, "series_truncated"),
+		Help: "Number of values dropped because of the series limit.",
+	})
+	path.scrapeDuration = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: prometheus.BuildFQName(c.Namespace, path.subsystem, "scrape_duration_seconds"),
+		Help: fmt.Sprintf("Duration of the last scrape of %s in seconds.", URI_path),
+	})
+	path.lastScrapeTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: prometheus.BuildFQName(c.Namespace, path.subsystem, "last_scrape_timestamp_seconds"),
+		Help: fmt.Sprintf("Unix time of the last successful scrape of %s.", URI_path),
+	})
+	path.statusCode = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: prometheus.BuildFQName(c.Namespace, path.subsystem, "http_status_code"),
+		Help: fmt.Sprintf("HTTP status code of the last scrape of %s, 0 if it failed without a response.", URI_path),
+	})
+	path.responseBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: prometheus.BuildFQName(c.Namespace, path.subsystem, "response_bytes"),
+		Help: fmt.Sprintf("Size of the last response body of %s in bytes.", URI_path),
+	})
+	path.responseBytesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(c.Namespace, path.subsystem, "response_bytes_total"),
+		Help: fmt.Sprintf("Total size of the response bodies of %s in bytes.", URI_path),
+	})
+	path.seriesCount = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: prometheus.BuildFQName(c.Namespace, path.subsystem, "series_count"),
+		Help: fmt.Sprintf("Number of metric names exported by the last scrape of %s.", URI_path),
+	})
+	path.registeredGauges = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: prometheus.BuildFQName(c.Namespace, path.subsystem, "registered_gauges"),
+		Help: fmt.Sprintf("Number of gauges exported from the last response of %s.", URI_path),
+	})
+	path.maxDepthReached = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: prometheus.BuildFQName(c.Namespace, path.subsystem, "max_depth_reached"),
+		Help: fmt.Sprintf("Deepest nesting level of the last response of %s traversed while flattening it.", URI_path),
+	})
+	path.lastParseError = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: prometheus.BuildFQName(c.Namespace, path.subsystem, "last_parse_error"),
+		Help: fmt.Sprintf("Whether parsing the last response of %s failed, with the truncated error as label.", URI_path),
+	}, []string{"error"})
+	path.setLastParseError()
+	path.clusterNameResolved = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: prometheus.BuildFQName(c.Namespace, path.subsystem, "cluster_name_resolved"),
+		Help: "Whether the name of the ElasticSearch cluster is known (1) or the cluster label is empty (0).",
+	})
+	if c.ClusterName != "" {
+		path.clusterNameResolved.Set(1)
+	}
+	path.clusterInfo = path.newClusterInfo(info)
+
+	return path
+}
+
+// newClusterInfo creates the cluster_info metric of info.
+func (c *genericPath) newClusterInfo(info NameResponse) prometheus.Gauge {
+	g := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: prometheus.BuildFQName(c.Namespace, c.subsystem, "cluster_info"),
+		Help: "Name, uuid and version of the ElasticSearch cluster.",
+		ConstLabels: prometheus.Labels{
+			c.ClusterLabel: info.ClusterName,
+			"uuid":         info.ClusterUUID,
+			"version":      info.Version.Number,
+		},
+	})
+	g.Set(1)
+	return g
+}
+
+// SetContext sets the context that outgoing requests of following scrapes are
+// bound to, so they get cancelled together with the incoming scrape. A nil
+// context detaches the exporter again.
+func (c *GenericExporter) SetContext(ctx context.Context) {
+	c.ctxMutex.Lock()
+	defer c.ctxMutex.Unlock()
+	c.ctx = ctx
+}
+
+func (c *GenericExporter) context() context.Context {
+	c.ctxMutex.Lock()
+	defer c.ctxMutex.Unlock()
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// ContextHandler wraps next so that the given exporters bind their outgoing
+// requests to the context of the incoming scrape request. Scrapes of the same
+// exporters are served one after another, so an overlapping scrape can't
+// replace the context of a running one. Exporters shared by several handlers
+// must be passed to each of them in the same order.
+func ContextHandler(next http.Handler, exporters ...*GenericExporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, e := range exporters {
+			e.scrapeMutex.Lock()
+			defer e.scrapeMutex.Unlock()
+			e.SetContext(r.Context())
+		}
+		defer func() {
+			for _, e := range exporters {
+				e.SetContext(nil)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (c *GenericExporter) Describe(ch chan<- *prometheus.Desc) {
+	for _, p := range c.paths {
+		p.describe(ch)
+	}
+}
+
+func (c *genericPath) describe(ch chan<- *prometheus.Desc) {
+	c.upVec.Describe(ch)
+	ch <- c.totalScrapes.Desc()
+	c.scrapeErrors.Describe(ch)
+	ch <- c.jsonParseFailures.Desc()
+	ch <- c.seriesTruncated.Desc()
+	ch <- c.unhandledFields.Desc()
+	ch <- c.scrapeDuration.Desc()
+	ch <- c.lastScrapeTimestamp.Desc()
+	ch <- c.statusCode.Desc()
+	ch <- c.responseBytes.Desc()
+	ch <- c.responseBytesTotal.Desc()
+	ch <- c.seriesCount.Desc()
+	ch <- c.registeredGauges.Desc()
+	ch <- c.maxDepthReached.Desc()
+	c.lastParseError.Describe(ch)
+	ch <- c.clusterNameResolved.Desc()
+	ch <- c.clusterInfo.Desc()
+
+	for _, g := range c.gauges {
+		g.Describe(ch)
+	}
+	for _, desc := range c.counters {
+		ch <- desc
+	}
+}
+
+func (c *GenericExporter) Collect(ch chan<- prometheus.Metric) {
+	c.mutex.Lock() // To protect metrics from concurrent collects.
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return
+	}
+	c.resolveClusterName()
+
+	// Each path only touches its own metrics, so they can be queried in
+	// parallel.
+	concurrency := c.MaxConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, p := range c.paths {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(p *genericPath) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			p.collect(ch)
+		}(p)
+	}
+	wg.Wait()
+}
+
+// Preview scrapes every URI path once and returns the sorted names of the
+// metrics they yield, e.g. to estimate the cardinality of a new path. The
+// reported metrics of the exporter are left untouched.
+func (c *GenericExporter) Preview() ([]string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	info := NameResponse{ClusterName: c.ClusterName, ClusterUUID: c.ClusterUUID}
+	var names []string
+	for _, p := range c.paths {
+		preview := c.newPath(p.URI_path, info)
+		ch := make(chan prometheus.Metric)
+		done := make(chan struct{})
+		go func() {
+			for range ch {
+			}
+			close(done)
+		}()
+		preview.collect(ch)
+		close(ch)
+		<-done
+
+		// The cache timestamp is only set by successful scrapes.
+		if preview.cachedAt.IsZero() {
+			return nil, fmt.Errorf("failed to scrape URI path %s", p.URI_path)
+		}
+		for _, name := range preview.fqNames {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Close stops the exporter, further collects don't report any metrics. It waits
+// for a running collect to finish and releases the idle connections of the
+// transport if the exporter created its own, the shared client passed to
+// NewGenericQuery is left untouched.
+func (c *GenericExporter) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.closed = true
+	if c.transport != nil {
+		c.transport.CloseIdleConnections()
+	}
+	return nil
+}
+
+// resolveClusterName fetches the cluster name again if it couldn't be
+// resolved before, so the metrics get labeled once the root endpoint recovers.
+// Collects wait for it, so it retries at most every clusterNameRetryInterval.
+func (c *GenericExporter) resolveClusterName() {
+	if c.ClusterName != "" || time.Now().Before(c.clusterNameRetryAt) {
+		return
+	}
+	info, err := c.fetchClusterInfo(c.context(), c.Timeout)
+	if err == nil && info.ClusterName == "" {
+		err = fmt.Errorf("empty cluster name")
+	}
+	if err != nil {
+		level.Warn(c.logger).Log(
+			"msg", "Cluster Name is still unresolved",
+			"err", err,
+		)
+		c.clusterNameRetryAt = time.Now().Add(clusterNameRetryInterval)
+		return
+	}
+	c.ClusterName = info.ClusterName
+	c.ClusterUUID = info.ClusterUUID
+	for _, p := range c.paths {
+		p.clusterNameResolved.Set(1)
+		p.clusterInfo = p.newClusterInfo(info)
+	}
+}
+
+// collect queries the URI path and reports its metrics.
+func (c *genericPath) collect(ch chan<- prometheus.Metric) {
+	if c.CacheTTL > 0 && time.Since(c.cachedAt) < c.CacheTTL {
+		if c.Debug {
+			level.Debug(c.logger).Log(
+				"msg", "Reporting cached metrics.",
+				"path", c.URI_path,
+			)
+		}
+		c.collectSelfMetrics(ch)
+		c.collectMetrics(ch)
+		return
+	}
+
+	full_path := *c.url
+	path, rawQuery := splitPath(c.URI_path)
+	full_path.Path = path
+	full_path.RawPath = escapePath(path)
+	// The query string was validated with the path.
+	full_path.RawQuery = escapeQuery(rawQuery)
+	if query, _ := url.ParseQuery(rawQuery); isCatPath(path) && query["format"] == nil {
+		if full_path.RawQuery != "" {
+			full_path.RawQuery += "&"
+		}
+		full_path.RawQuery += "format=json"
+	}
+	c.totalScrapes.Inc()
+	start := time.Now()
+	series := 0
+	defer func() {
+		c.scrapeDuration.Set(time.Since(start).Seconds())
+		c.seriesCount.Set(float64(series))
+		c.collectSelfMetrics(ch)
+	}()
+
+	ctx := c.context()
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	resp, err := c.do(ctx, c.Method, &full_path, c.Body)
+	if err != nil {
+		c.up.Set(0)
+		c.statusCode.Set(0)
+		c.scrapeErrors.WithLabelValues(scrapeErrorConnection).Inc()
+		if ctx.Err() == context.DeadlineExceeded {
+			level.Warn(c.logger).Log(
+				"msg", "Timed out while querying Json endpoint.",
+				"path", c.URI_path,
+				"timeout", c.Timeout,
+			)
+			return
+		}
+		level.Warn(c.logger).Log(
+			"msg", "Error while querying Json endpoint.",
+			"path", c.URI_path,
+			"err", err,
+		)
+		return
+	}
+	defer resp.Body.Close()
+	c.statusCode.Set(float64(resp.StatusCode))
+
+	if resp.StatusCode != http.StatusOK {
+		c.up.Set(0)
+		c.scrapeErrors.WithLabelValues(scrapeErrorHTTPStatus).Inc()
+		level.Warn(c.logger).Log(
+			"msg", "Error while querying Json endpoint.",
+			"path", c.URI_path,
+			"err", fmt.Errorf("HTTP Request failed with code %d", resp.StatusCode),
+		)
+		return
+	}
+
+	reader, err := responseBody(resp)
+	if err != nil {
+		level.Warn(c.logger).Log(
+			"msg", "Failed to decompress Json response body.",
+			"err", err,
+		)
+		c.up.Set(0)
+		c.scrapeErrors.WithLabelValues(scrapeErrorParse).Inc()
+		return
+	}
+	defer reader.Close()
+
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		level.Warn(c.logger).Log(
+			"msg", "Failed to read Json response body.",
+			"err", err,
+		)
+		c.up.Set(0)
+		c.scrapeErrors.WithLabelValues(scrapeErrorConnection).Inc()
+		return
+	}
+	c.responseBytes.Set(float64(len(body)))
+	c.responseBytesTotal.Add(float64(len(body)))
+
+	// An empty body almost always means that the path is wrong, not that the
+	// response is malformed.
+	if len(bytes.TrimSpace(body)) == 0 {
+		level.Warn(c.logger).Log(
+			"msg", "Empty response body from Json endpoint.",
+			"path", c.URI_path,
+		)
+		c.up.Set(0)
+		c.scrapeErrors.WithLabelValues(scrapeErrorParse).Inc()
+		return
+	}
+
+	c.up.Set(1)
+
+	var allStats interface{}
+	if contentType := resp.Header.Get("Content-Type"); !isJSONResponse(contentType, body) {
+		err = fmt.Errorf("unexpected content type %q", contentType)
+	} else {
+		err = unmarshalJSON(body, &allStats)
+	}
+	if err == nil {
+		switch allStats.(type) {
+		case map[string]interface{}, []interface{}:
+		default:
+			err = fmt.Errorf("expected a JSON object or array, got %T", allStats)
+		}
+	}
+	if err != nil {
+		c.parseFailed(err)
+		c.setLastParseError()
+		c.scrapeErrors.WithLabelValues(scrapeErrorParse).Inc()
+		level.Warn(c.logger).Log(
+			"msg", "Failed to unmarshal JSON into struct.",
+			"path", c.URI_path,
+			"content_type", resp.Header.Get("Content-Type"),
+			"err", err,
+		)
+		return
+	}
+	c.lastScrapeTimestamp.Set(float64(time.Now().Unix()))
+
+	// Extracrt the metrics from the json interface
+	c.seen = make(map[string]bool)
+	c.keys = make(map[string]string)
+	c.counterMetrics = make(map[string]prometheus.Metric)
+	c.depthReached = 0
+	c.parseError = ""
+	for _, g := range c.gauges {
+		g.Reset()
+	}
+	var labels metricLabels
+	if !c.OmitClusterLabel {
+		labels = labels.with(c.ClusterLabel, c.ClusterName)
+	}
+	if c.ClusterUUIDLabel {
+		labels = labels.with("cluster_uuid", c.ClusterUUID)
+	}
+	switch stats := allStats.(type) {
+	case map[string]interface{}:
+		c.extractJSON("", 1, labels, stats)
+	case []interface{}:
+		c.extractJSONArray("", 1, labels, stats)
+	}
+
+	// Drop metrics which are gone from the response
+	for name := range c.labelNames {
+		if !c.seen[name] {
+			delete(c.gauges, name)
+			delete(c.counters, name)
+			delete(c.labelNames, name)
+			delete(c.fqNames, name)
+		}
+	}
+	series = len(c.gauges) + len(c.counters)
+	c.registeredGauges.Set(float64(len(c.gauges)))
+	c.maxDepthReached.Set(float64(c.depthReached))
+	c.setLastParseError()
+	c.cachedAt = time.Now()
+
+	c.collectMetrics(ch)
+}
+
+// isJSONResponse reports whether a response body of the given content type
+// can be JSON. Elasticsearch labels JSON as application/json, but text/plain
+// is accepted as long as the body looks like JSON, since that is what Go's
+// content sniffing and some proxies label it as.
+func isJSONResponse(contentType string, body []byte) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		return true
+	case mediaType == "text/plain":
+		body = bytes.TrimSpace(body)
+		return len(body) > 0 && (body[0] == '{' || body[0] == '[')
+	}
+	return false
+}
+
+// unmarshalJSON decodes data into v like json.Unmarshal does, but keeps numbers
+// as json.Number so they are only converted to float64 when exported.
+func unmarshalJSON(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if dec.More() {
+		return fmt.Errorf("unexpected data after the JSON value")
+	}
+	return nil
+}
+
+// parseFailed counts a failure to parse JSON and remembers err for the
+// last_parse_error metric.
+func (c *genericPath) parseFailed(err error) {
+	c.jsonParseFailures.Inc()
+	c.parseError = err.Error()
+}
+
+// setLastParseError exports the error remembered by parseFailed, or an empty
+// error if the last response was parsed cleanly.
+func (c *genericPath) setLastParseError() {
+	c.lastParseError.Reset()
+	if c.parseError == "" {
+		c.lastParseError.WithLabelValues("").Set(0)
+		return
+	}
+	msg := []rune(c.parseError)
+	if len(msg) > maxParseErrorLength {
+		msg = append(msg[:maxParseErrorLength], []rune("...")...)
+	}
+	c.lastParseError.WithLabelValues(string(msg)).Set(1)
+}
+
+// collectMetrics reports the metrics extracted from the last response.
+func (c *genericPath) collectMetrics(ch chan<- prometheus.Metric) {
+	for _, g := range c.gauges {
+		g.Collect(ch)
+	}
+	for _, m := range c.counterMetrics {
+		ch <- m
+	}
+}
+
+// escapeQuery escapes the parameters of the query string rawQuery which can't
+// be sent as is. Unlike url.Values.Encode it keeps the order of the parameters
+// and flags like v without a value.
+func escapeQuery(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	params := strings.Split(rawQuery, "&")
+	for i, param := range params {
+		if validQueryParam.MatchString(param) {
+			continue
+		}
+		parts := strings.SplitN(param, "=", 2)
+		for j, part := range parts {
+			// The query string was validated, so unescaping can't fail.
+			part, _ = url.QueryUnescape(part)
+			parts[j] = url.QueryEscape(part)
+		}
+		params[i] = strings.Join(parts, "=")
+	}
+	return strings.Join(params, "&")
+}
+
+// splitPath splits URI_path into the path and the query string.
+func splitPath(URI_path string) (string, string) {
+	if i := strings.Index(URI_path, "?"); i >= 0 {
+		return URI_path[:i], URI_path[i+1:]
+	}
+	return URI_path, ""
+}
+
+// escapePath escapes path for the request line. Date math index names like
+// <logs-{now/d}> are escaped as a whole, including their slashes, since they
+// would be split into separate segments otherwise.
+func escapePath(path string) string {
+	var escaped strings.Builder
+	for path != "" {
+		i := strings.Index(path, "<")
+		if i < 0 {
+			i = len(path)
+		}
+		escaped.WriteString((&url.URL{Path: path[:i]}).EscapedPath())
+		path = path[i:]
+		if path == "" {
+			break
+		}
+		j := strings.Index(path, ">") + 1
+		if j == 0 {
+			j = len(path)
+		}
+		escaped.WriteString(url.PathEscape(path[:j]))
+		path = path[j:]
+	}
+	return escaped.String()
+}
+
+// isCatPath reports whether path queries one of the _cat APIs, which respond
+// with plain text tables unless asked for JSON.
+func isCatPath(path string) bool {
+	path = strings.TrimLeft(path, "/")
+	return path == "_cat" || strings.HasPrefix(path, "_cat/")
+}
 
-	return &exporter
+// collectSelfMetrics reports the metrics about the scrapes of the URI path.
+func (c *genericPath) collectSelfMetrics(ch chan<- prometheus.Metric) {
+	c.upVec.Collect(ch)
+	ch <- c.totalScrapes
+	c.scrapeErrors.Collect(ch)
+	ch <- c.jsonParseFailures
+	ch <- c.seriesTruncated
+	ch <- c.unhandledFields
+	ch <- c.scrapeDuration
+	ch <- c.lastScrapeTimestamp
+	ch <- c.statusCode
+	ch <- c.responseBytes
+	ch <- c.responseBytesTotal
+	ch <- c.seriesCount
+	ch <- c.registeredGauges
+	ch <- c.maxDepthReached
+	c.lastParseError.Collect(ch)
+	ch <- c.clusterNameResolved
+	ch <- c.clusterInfo
 }
 
-func (c *GenericExporter) Describe(ch chan<- *prometheus.Desc) {
-	ch <- c.up.Desc()
-	ch <- c.totalScrapes.Desc()
-	ch <- c.jsonParseFailures.Desc()
+// metricLabels holds the label names and values of a flattened metric.
+type metricLabels struct {
+	names, values []string
+}
 
-	for _, g := range c.gauges {
-		g.Describe(ch)
+// with returns a copy of l extended by the label name with value.
+func (l metricLabels) with(name, value string) metricLabels {
+	return metricLabels{
+		names:  append(append([]string{}, l.names...), name),
+		values: append(append([]string{}, l.values...), value),
 	}
 }
 
-func (c *GenericExporter) Collect(ch chan<- prometheus.Metric) {
-	c.mutex.Lock() // To protect metrics from concurrent collects.
-	defer c.mutex.Unlock()
-
-	full_path := *c.url
-	full_path.Path = c.URI_path
-	c.totalScrapes.Inc()
-	defer func() {
-		ch <- c.up
-		ch <- c.totalScrapes
-		ch <- c.jsonParseFailures
-	}()
+// has reports whether l contains the label name.
+func (l metricLabels) has(name string) bool {
+	for _, n := range l.names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
 
-	resp, err := c.client.Get(full_path.String())
-	if err != nil {
-		c.up.Set(0)
+func (c *genericPath) addGauge(name string, subsystem string, labels metricLabels, value float64, help string) {
+	if c.Exclude != nil && c.Exclude.MatchString(name) {
+		return
+	}
+	if c.Include != nil && !c.Include.MatchString(name) {
+		return
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		if c.Debug {
+			level.Debug(c.logger).Log(
+				name, "is not a finite number, skipping",
+				"value", value,
+			)
+		}
+		return
+	}
+	if c.SkipZeros && value == 0 {
+		return
+	}
+	key := name
+	name = sanitizeMetricName(name, c.Separator, c.PreserveCase)
+	if name == "" || !model.IsValidMetricName(model.LabelValue(prometheus.BuildFQName(c.Namespace, subsystem, name))) {
+		if c.Debug {
+			level.Debug(c.logger).Log(
+				"msg", "Key doesn't yield a valid metric name, skipping.",
+				"key", key,
+			)
+		}
+		return
+	}
+	if c.selfMetrics[prometheus.BuildFQName(c.Namespace, subsystem, name)] {
 		level.Warn(c.logger).Log(
-			"msg", "Error while querying Json endpoint.",
-			"err", err,
+			"msg", "Metric name collides with a self-metric, skipping.",
+			"metric", name,
 		)
 		return
 	}
-
-	body, err := ioutil.ReadAll(resp.Body)
+	if other, ok := c.keys[name]; ok && other != key {
+		level.Warn(c.logger).Log(
+			"msg", "Metric name collides with another key after sanitizing, skipping.",
+			"metric", name,
+			"key", key,
+			"other", other,
+		)
+		return
+	}
+	c.keys[name] = key
+	if c.MaxSeries > 0 && !c.seen[name] && len(c.seen) >= c.MaxSeries {
+		c.seriesTruncated.Inc()
+		if c.Debug {
+			level.Debug(c.logger).Log(
+				name, "exceeds the series limit, skipping",
+			)
+		}
+		return
+	}
+	if known, ok := c.labelNames[name]; ok && !equalStrings(known, labels.names) {
+		level.Warn(c.logger).Log(
+			"msg", "Metric was already added with different labels, skipping.",
+			"metric", name,
+			"labels", strings.Join(labels.names, ","),
+		)
+		return
+	}
+	if h, ok := c.Help[name]; ok {
+		help = h
+	}
+	if c.Counters != nil && c.Counters.MatchString(name) {
+		c.addCounter(name, subsystem, labels, value, help)
+		return
+	}
+	g, ok := c.gauges[name]
+	if !ok {
+		g = prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: c.Namespace, Subsystem: subsystem, Name: name, Help: help, ConstLabels: c.StaticLabels}, labels.names)
+		c.gauges[name] = g
+	}
+	c.labelNames[name] = labels.names
+	c.fqNames[name] = prometheus.BuildFQName(c.Namespace, subsystem, name)
+	c.seen[name] = true
+	m, err := g.GetMetricWithLabelValues(labels.values...)
 	if err != nil {
 		level.Warn(c.logger).Log(
-			"msg", "Failed to read Json response body.",
+			"msg", "Inconsistent labels for metric.",
+			"metric", name,
 			"err", err,
 		)
-		c.up.Set(0)
 		return
 	}
-	resp.Body.Close()
-
-	c.up.Set(1)
+	m.Set(value)
+}
 
-	var allStats map[string]interface{}
-	err = json.Unmarshal(body, &allStats)
+// addCounter records value as sample of the counter name, which is reported
+// as is since Elasticsearch keeps the count.
+func (c *genericPath) addCounter(name string, subsystem string, labels metricLabels, value float64, help string) {
+	desc, ok := c.counters[name]
+	if !ok {
+		desc = prometheus.NewDesc(prometheus.BuildFQName(c.Namespace, subsystem, name), help, labels.names, c.StaticLabels)
+		c.counters[name] = desc
+	}
+	key := name + "\xff" + strings.Join(labels.values, "\xff")
+	if _, ok := c.counterMetrics[key]; ok {
+		level.Warn(c.logger).Log(
+			"msg", "Counter was already added with the same labels, skipping.",
+			"metric", name,
+			"labels", strings.Join(labels.values, ","),
+		)
+		return
+	}
+	m, err := prometheus.NewConstMetric(desc, prometheus.CounterValue, value, labels.values...)
 	if err != nil {
 		level.Warn(c.logger).Log(
-			"msg", "Failed to unmarshal JSON into struct.",
+			"msg", "Inconsistent labels for metric.",
+			"metric", name,
 			"err", err,
 		)
 		return
 	}
+	c.labelNames[name] = labels.names
+	c.fqNames[name] = prometheus.BuildFQName(c.Namespace, subsystem, name)
+	c.seen[name] = true
+	c.counterMetrics[key] = m
+}
 
-	// Extracrt the metrics from the json interface
-	c.extractJSON("", allStats)
+// selfMetricNames are the names of the metrics every path reports about its
+// own scrapes, which flattened keys of no path must shadow.
+var selfMetricNames = map[string]bool{
+	"up":                            true,
+	"total_scrapes":                 true,
+	"json_parse_failures":           true,
+	"series_truncated":              true,
+	"registered_gauges":             true,
+	"unhandled_fields":              true,
+	"scrape_duration_seconds":       true,
+	"last_scrape_timestamp_seconds": true,
+	"http_status_code":              true,
+	"response_bytes":                true,
+	"response_bytes_total":          true,
+	"series_count":                  true,
+	"cluster_info":                  true,
+	"cluster_name_resolved":         true,
+	"max_depth_reached":             true,
+	"last_parse_error":              true,
+	"scrape_errors_total":           true,
+}
 
-	// Report metrics
-	for _, g := range c.gauges {
-		g.Collect(ch)
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// sanitizeMetricName lower-cases a flattened key unless preserveCase is set
+// and replaces every run of characters which aren't allowed in metric names
+// with a single underscore. The keys joined by separator are sanitized on
+// their own, so separators other than "_" are kept.
+func sanitizeMetricName(name string, separator string, preserveCase bool) string {
+	if !preserveCase {
+		name = strings.ToLower(name)
+		separator = strings.ToLower(separator)
+	}
+	keys := []string{name}
+	if separator != "_" {
+		keys = strings.Split(name, separator)
+	}
+	for i, key := range keys {
+		key = invalidMetricNameChars.ReplaceAllString(key, "_")
+		keys[i] = repeatedUnderscores.ReplaceAllString(key, "_")
+	}
+	name = strings.Join(keys, separator)
+	if len(name) > 0 && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+// addStringGauge exports a string value through the string mapping
+// configured for the metric or, if enabled, as a number. Other strings are
+// ignored.
+func (c *genericPath) addStringGauge(name string, labels metricLabels, value string) {
+	if c.DropStrings {
+		return
+	}
+	if values, ok := c.StringValues[name]; ok {
+		if v, ok := values[value]; ok {
+			c.addGauge(name, c.subsystem, labels, v, name)
+		}
+		return
+	}
+	if c.ParseNumericStrings {
+		if v, err := strconv.ParseFloat(value, 64); err == nil {
+			c.addGauge(name, c.subsystem, labels, v, name)
+			return
+		}
+	}
+	if c.ByteUnitBase != 0 {
+		if v, ok := parseBytes(value, c.ByteUnitBase); ok {
+			c.addGauge(name, c.subsystem, labels, v, name)
+			return
+		}
+	}
+	if c.ParseDurations {
+		if v, ok := parseDuration(value); ok {
+			c.addGauge(name+"_seconds", c.subsystem, labels, v, name+"_seconds")
+		}
+	}
+}
+
+// parseDuration converts Elasticsearch time values like "350ms" or "1.5s"
+// into seconds.
+func parseDuration(value string) (float64, bool) {
+	m := durationPattern.FindStringSubmatch(value)
+	if m == nil {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, false
 	}
+	return v * float64(durationUnits[m[2]]) / float64(time.Second), true
 }
 
-func (c *GenericExporter) addGauge(name string, subsystem string, value float64, help string) {
-	name = strings.ToLower(name)
-	c.gauges[name] = prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: namespace, Subsystem: subsystem, Name: name, Help: help}, []string{"cluster"})
-	c.gauges[name].WithLabelValues(c.ClusterName).Set(value)
+// parseBytes converts human readable sizes like "1.2gb" into bytes, using
+// base as the factor between the units.
+func parseBytes(value string, base float64) (float64, bool) {
+	m := byteSizePattern.FindStringSubmatch(strings.ToLower(value))
+	if m == nil {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, false
+	}
+	return v * math.Pow(base, byteUnitExponents[m[2]]), true
 }
 
-func (c *GenericExporter) extractJSON(metric string, jsonInt map[string]interface{}) {
+func (c *genericPath) extractJSON(metric string, depth int, labels metricLabels, jsonInt map[string]interface{}) {
+	if c.exceedsMaxDepth(metric, depth) {
+		return
+	}
+	if depth > c.depthReached {
+		c.depthReached = depth
+	}
 	newMetric := ""
-	debug := false
 	fix_double_underscore := regexp.MustCompile("^_(.+)")
 
-	for k, v := range jsonInt {
+	// Sorted, so the first of keys sanitized to the same name always wins.
+	keys := make([]string, 0, len(jsonInt))
+	for k := range jsonInt {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := jsonInt[k]
+		if depth == 1 && metric == "" && !c.isTopLevelKey(k) {
+			continue
+		}
 		if len(metric) > 0 {
-			newMetric = metric + "_" + k
+			newMetric = metric + c.Separator + k
 			newMetric = fix_double_underscore.ReplaceAllString(newMetric, "$1")
 		} else {
 			newMetric = k
 		}
 		switch vv := v.(type) {
 		case string:
-			if debug {
-				level.Warn(c.logger).Log(
-					newMetric, "is string",
-					"type", vv,
-				)
-			}
-			//Handle the case where the string contains json value
-			if len(vv) > 2 && vv[0] == '{' {
-				var stats map[string]interface{}
-				err := json.Unmarshal([]byte(vv), &stats)
-				if err != nil {
-					level.Warn(c.logger).Log(
-						"Failed to parse json from string", newMetric,
-						"err", err,
+			if c.DropHumanReadable && hasRawSibling(jsonInt, k) {
+				if c.Debug {
+					level.Debug(c.logger).Log(
+						newMetric, "has a raw sibling, skipping",
 					)
-				} else {
-					if debug {
-						level.Warn(c.logger).Log(
-							"Extracting json values from the string ", newMetric,
-						)
-					}
-					c.extractJSON(newMetric, stats)
 				}
+				continue
 			}
-		case int:
-			if debug {
-				level.Warn(c.logger).Log(
-					newMetric, "is int",
-					"type", vv,
-				)
+		case map[string]interface{}:
+			if c.extractObject(k, newMetric, depth, labels, vv) {
+				continue
 			}
-			c.addGauge(newMetric, c.subsystem, float64(vv), newMetric)
-		case float64:
-			if debug {
+		}
+		c.emitValue(newMetric, depth, labels, v)
+	}
+}
+
+// extractObject extracts the objects which are exported specially, like the
+// tasks of _tasks or the nodes of node stats responses, and reports whether
+// the object under key was one of them.
+func (c *genericPath) extractObject(key, metric string, depth int, labels metricLabels, obj map[string]interface{}) bool {
+	switch {
+	case key == "tasks" && c.TasksLabel:
+		c.extractTasks(depth+1, labels, obj)
+	case key == "shards" && c.ShardLabels && isShardMap(obj):
+		c.extractShards(metric, depth+1, labels, obj)
+	case metric == "nodes" && (c.NodeFilter != "" || c.NodeRolesLabel || len(c.NodeAttributeLabels) > 0):
+		if c.NodeFilter != "" {
+			obj = c.filterNodes(obj)
+		}
+		c.extractNodes(metric, depth+1, labels, obj)
+	default:
+		label, ok := c.LabelKeys[metric]
+		if !ok {
+			return false
+		}
+		c.extractLabeled(metric, depth+1, labels, label, obj)
+	}
+	return true
+}
+
+// emitValue exports the field metric of an object or array at depth by its
+// type, descending into nested objects and arrays, including those encoded
+// in strings.
+func (c *genericPath) emitValue(metric string, depth int, labels metricLabels, v interface{}) {
+	switch vv := v.(type) {
+	case string:
+		if c.Debug {
+			level.Debug(c.logger).Log(
+				metric, "is string",
+				"type", vv,
+			)
+		}
+		//Handle the case where the string contains json value
+		if len(vv) > 2 && vv[0] == '{' {
+			var stats map[string]interface{}
+			err := unmarshalJSON([]byte(vv), &stats)
+			if err != nil {
+				c.parseFailed(err)
 				level.Warn(c.logger).Log(
-					newMetric, "is float",
-					"type", vv,
+					"Failed to parse json from string", metric,
+					"err", err,
 				)
+				return
 			}
-			c.addGauge(newMetric, c.subsystem, vv, newMetric)
-		case bool:
-			if vv {
-				if debug {
-					level.Warn(c.logger).Log(
-						newMetric, "is a bool => 1",
-					)
-				}
-				c.addGauge(newMetric, c.subsystem, float64(1), newMetric)
-			} else {
-				if debug {
-					level.Warn(c.logger).Log(
-						newMetric, "is a bool => 0",
-					)
-				}
-				c.addGauge(newMetric, c.subsystem, float64(0), newMetric)
+			if c.Debug {
+				level.Debug(c.logger).Log(
+					"Extracting json values from the string ", metric,
+				)
 			}
-		case map[string]interface{}:
-			if debug {
+			c.extractJSON(metric, depth+1, labels, stats)
+		} else if len(vv) > 2 && vv[0] == '[' {
+			var stats []interface{}
+			err := unmarshalJSON([]byte(vv), &stats)
+			if err != nil {
+				c.parseFailed(err)
 				level.Warn(c.logger).Log(
-					newMetric, "is a hash",
+					"Failed to parse json from string", metric,
+					"err", err,
 				)
+				return
 			}
-			c.extractJSON(newMetric, vv)
-		case []interface{}:
-			if debug {
-				level.Warn(c.logger).Log(
-					newMetric, "is an array",
+			c.extractJSONArray(metric, depth+1, labels, stats)
+		} else {
+			c.addStringGauge(metric, labels, vv)
+		}
+	case int, float64, json.Number:
+		if c.DropNumbers {
+			return
+		}
+		if c.Debug {
+			level.Debug(c.logger).Log(
+				metric, "is float",
+				"type", vv,
+			)
+		}
+		f, err := floatValue(vv)
+		if err != nil {
+			c.parseFailed(err)
+			return
+		}
+		c.addGauge(metric, c.subsystem, labels, f, metric)
+	case bool:
+		if c.DropBools {
+			return
+		}
+		if vv {
+			if c.Debug {
+				level.Debug(c.logger).Log(
+					metric, "is a bool => 1",
 				)
 			}
-			c.extractJSONArray(newMetric, vv)
-		default:
-			if debug {
-				level.Warn(c.logger).Log(
-					newMetric, "is of a type I don't know how to handle",
+			c.addGauge(metric, c.subsystem, labels, float64(1), metric)
+		} else {
+			if c.Debug {
+				level.Debug(c.logger).Log(
+					metric, "is a bool => 0",
 				)
 			}
+			c.addGauge(metric, c.subsystem, labels, float64(0), metric)
+		}
+	case map[string]interface{}:
+		if c.Debug {
+			level.Debug(c.logger).Log(
+				metric, "is a hash",
+			)
+		}
+		c.extractJSON(metric, depth+1, labels, vv)
+	case []interface{}:
+		if c.Debug {
+			level.Debug(c.logger).Log(
+				metric, "is an array",
+			)
+		}
+		c.extractJSONArray(metric, depth+1, labels, vv)
+	default:
+		c.unhandledFields.Inc()
+		if c.Debug {
+			level.Debug(c.logger).Log(
+				metric, "is of a type I don't know how to handle",
+				"type", fmt.Sprintf("%T", vv),
+			)
 		}
 	}
 }
 
-// Extract metrics from json array interface
-func (c *GenericExporter) extractJSONArray(metric string, jsonInt []interface{}) {
-	newMetric := ""
-	debug := false
-	for k, v := range jsonInt {
-		if len(metric) > 0 {
-			newMetric = metric + "_" + strconv.Itoa(k)
-		} else {
-			newMetric = strconv.Itoa(k)
+// hasRawSibling reports whether obj holds the raw value of the human readable
+// field key, e.g. heap_used_in_bytes for heap_used.
+func hasRawSibling(obj map[string]interface{}, key string) bool {
+	for _, suffix := range []string{"_in_bytes", "_in_millis"} {
+		if _, ok := obj[key+suffix]; ok {
+			return true
 		}
-		switch vv := v.(type) {
-		case string:
-			if debug {
-				level.Warn(c.logger).Log(
-					newMetric, "is string",
-					"type", vv,
+	}
+	return false
+}
+
+// isTopLevelKey reports whether the top level field key of an object response
+// is in the TopLevelKeys allowlist, which is empty by default.
+func (c *genericPath) isTopLevelKey(key string) bool {
+	if len(c.TopLevelKeys) == 0 {
+		return true
+	}
+	for _, k := range c.TopLevelKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// exceedsMaxDepth reports whether the fields of the object or array metric at
+// the given nesting depth are beyond the configured MaxDepth.
+func (c *genericPath) exceedsMaxDepth(metric string, depth int) bool {
+	if c.MaxDepth == 0 || depth <= c.MaxDepth {
+		return false
+	}
+	if c.Debug {
+		level.Debug(c.logger).Log(
+			metric, "exceeds the max depth, skipping",
+			"depth", depth,
+		)
+	}
+	return true
+}
+
+// filterNodes returns the entries of the nodes map of node stats responses
+// whose id or name equals the NodeFilter.
+func (c *genericPath) filterNodes(nodes map[string]interface{}) map[string]interface{} {
+	filtered := make(map[string]interface{})
+	for id, v := range nodes {
+		node, _ := v.(map[string]interface{})
+		if id == c.NodeFilter || (node != nil && node["name"] == c.NodeFilter) {
+			filtered[id] = v
+		}
+	}
+	return filtered
+}
+
+// extractLabeled extracts the objects of a map keyed by e.g. node ids under
+// the shared metric name, carrying their keys as label values instead. If an
+// enclosing object already set the label, the keys are flattened into the
+// metric names like extractJSON does.
+func (c *genericPath) extractLabeled(metric string, depth int, labels metricLabels, label string, jsonInt map[string]interface{}) {
+	for k, v := range jsonInt {
+		stats, ok := v.(map[string]interface{})
+		if !ok {
+			if c.Debug {
+				level.Debug(c.logger).Log(
+					metric+c.Separator+k, "is not a hash, can't use its key as label",
 				)
 			}
-			if len(vv) > 2 && vv[0] == '{' {
-				var stats map[string]interface{}
-				err := json.Unmarshal([]byte(vv), &stats)
-				if err != nil {
-					level.Warn(c.logger).Log(
-						"Failed to parse json from string", newMetric,
-						"err", err,
-					)
-				} else {
-					c.extractJSON(newMetric, stats)
-					if debug {
-						level.Warn(c.logger).Log(
-							"Extracting json values from the string ", newMetric,
-						)
-					}
-				}
-			}
-		case int:
-			if debug {
-				level.Warn(c.logger).Log(
-					newMetric, "is int",
-					"type", vv,
+			continue
+		}
+		if labels.has(label) {
+			c.extractJSON(metric+c.Separator+k, depth+1, labels, stats)
+		} else {
+			c.extractJSON(metric, depth+1, labels.with(label, k), stats)
+		}
+	}
+}
+
+// extractNodes extracts the stats of the nodes in the nodes map like
+// extractJSON or, if it has a label key, extractLabeled do, adding the labels
+// of each node.
+func (c *genericPath) extractNodes(metric string, depth int, labels metricLabels, nodes map[string]interface{}) {
+	label, labeled := c.LabelKeys[metric]
+	for id, v := range nodes {
+		node, ok := v.(map[string]interface{})
+		if !ok {
+			if c.Debug {
+				level.Debug(c.logger).Log(
+					metric+c.Separator+id, "is not a hash, can't read its node labels",
 				)
 			}
-			c.addGauge(newMetric, c.subsystem, float64(vv), newMetric)
-		case float64:
-			if debug {
-				level.Warn(c.logger).Log(
-					newMetric, "is float",
-					"type", vv,
+			continue
+		}
+		nodeLabels := c.withNodeLabels(labels, node)
+		if labeled && !nodeLabels.has(label) {
+			c.extractJSON(metric, depth+1, nodeLabels.with(label, id), node)
+		} else {
+			c.extractJSON(metric+c.Separator+id, depth+1, nodeLabels, node)
+		}
+	}
+}
+
+// extractTasks extracts the tasks of a tasks map keyed by task id under the
+// metric name tasks, with the id, action and node of each task as labels.
+func (c *genericPath) extractTasks(depth int, labels metricLabels, tasks map[string]interface{}) {
+	for id, v := range tasks {
+		task, ok := v.(map[string]interface{})
+		if !ok {
+			if c.Debug {
+				level.Debug(c.logger).Log(
+					"tasks"+c.Separator+id, "is not a hash, can't use its id as label",
 				)
 			}
-			c.addGauge(newMetric, c.subsystem, vv, newMetric)
-		case bool:
-			if vv {
-				if debug {
-					level.Warn(c.logger).Log(
-						newMetric, "is bool => 1",
-					)
-				}
-				c.addGauge(newMetric, c.subsystem, float64(1), newMetric)
-			} else {
-				if debug {
-					level.Warn(c.logger).Log(
-						newMetric, "is bool => 0",
-					)
-				}
-				c.addGauge(newMetric, c.subsystem, float64(0), newMetric)
-			}
+			continue
+		}
+		taskLabels := labels.with("task", id)
+		action, _ := task["action"].(string)
+		taskLabels = taskLabels.with("action", action)
+		if !taskLabels.has("node") {
+			node, _ := task["node"].(string)
+			taskLabels = taskLabels.with("node", node)
+		}
+		c.extractJSON("tasks", depth+1, taskLabels, task)
+	}
+}
+
+// isShardMap reports whether all keys of shards are shard numbers, unlike e.g.
+// the shard counts of _cluster/stats.
+func isShardMap(shards map[string]interface{}) bool {
+	for k := range shards {
+		if _, err := strconv.Atoi(k); err != nil {
+			return false
+		}
+	}
+	return len(shards) > 0
+}
+
+// extractShards extracts the shards of a shards map keyed by shard number under
+// the shared metric name with a shard label. The copies of a shard, listed in
+// an array by _stats, are told apart by the primary and node of their routing.
+func (c *genericPath) extractShards(metric string, depth int, labels metricLabels, shards map[string]interface{}) {
+	for shard, v := range shards {
+		shardLabels := labels.with("shard", shard)
+		switch vv := v.(type) {
 		case map[string]interface{}:
-			if debug {
-				level.Warn(c.logger).Log(
-					newMetric, "is hash",
-				)
-			}
-			c.extractJSON(newMetric, vv)
+			c.extractJSON(metric, depth+1, shardLabels, vv)
 		case []interface{}:
-			if debug {
-				level.Warn(c.logger).Log(
-					newMetric, "is an array",
-				)
+			for _, shardCopy := range vv {
+				stats, ok := shardCopy.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				routing, _ := stats["routing"].(map[string]interface{})
+				primary, _ := routing["primary"].(bool)
+				node, _ := routing["node"].(string)
+				copyLabels := shardLabels.with("primary", strconv.FormatBool(primary))
+				if !copyLabels.has("node") {
+					copyLabels = copyLabels.with("node", node)
+				}
+				c.extractJSON(metric, depth+1, copyLabels, stats)
 			}
-			c.extractJSONArray(newMetric, vv)
 		default:
-			if debug {
-				level.Warn(c.logger).Log(
-					newMetric, "is of a type I don't know how to handle",
+			if c.Debug {
+				level.Debug(c.logger).Log(
+					metric+c.Separator+shard, "is not a hash or an array, can't use its shard number as label",
 				)
 			}
 		}
 	}
 }
+
+// withNodeLabels adds the configured roles and attribute labels of a node of
+// the nodes map to labels.
+func (c *genericPath) withNodeLabels(labels metricLabels, node map[string]interface{}) metricLabels {
+	if c.NodeRolesLabel {
+		var roles []string
+		list, _ := node["roles"].([]interface{})
+		for _, role := range list {
+			if r, ok := role.(string); ok {
+				roles = append(roles, r)
+			}
+		}
+		sort.Strings(roles)
+		labels = labels.with("roles", strings.Join(roles, ","))
+	}
+	if len(c.NodeAttributeLabels) == 0 {
+		return labels
+	}
+	attributes := make([]string, 0, len(c.NodeAttributeLabels))
+	for attribute := range c.NodeAttributeLabels {
+		attributes = append(attributes, attribute)
+	}
+	sort.Strings(attributes)
+	values, _ := node["attributes"].(map[string]interface{})
+	for _, attribute := range attributes {
+		value, _ := values[attribute].(string)
+		labels = labels.with(c.NodeAttributeLabels[attribute], value)
+	}
+	return labels
+}
+
+// scalarValues returns the elements of jsonInt if it is a non-empty array of
+// numbers only.
+func (c *genericPath) scalarValues(jsonInt []interface{}) ([]float64, bool) {
+	if len(jsonInt) == 0 {
+		return nil, false
+	}
+	values := make([]float64, 0, len(jsonInt))
+	for _, v := range jsonInt {
+		f, err := floatValue(v)
+		if err != nil {
+			return nil, false
+		}
+		values = append(values, f)
+	}
+	return values, true
+}
+
+// floatValue converts a number decoded from JSON to float64. Numbers out of
+// the range of float64 become infinite instead of failing.
+func floatValue(v interface{}) (float64, error) {
+	switch vv := v.(type) {
+	case int:
+		return float64(vv), nil
+	case float64:
+		return vv, nil
+	case json.Number:
+		f, err := vv.Float64()
+		if err != nil && !errors.Is(err, strconv.ErrRange) {
+			return 0, err
+		}
+		return f, nil
+	}
+	return 0, fmt.Errorf("%T is not a number", v)
+}
+
+// addArrayStats exports the sum, min, max and count of the elements of the
+// scalar array metric as configured by ScalarArrays.
+func (c *genericPath) addArrayStats(metric string, labels metricLabels, values []float64) {
+	if c.DropNumbers {
+		return
+	}
+	sum, min, max := 0.0, values[0], values[0]
+	for _, v := range values {
+		sum += v
+		min = math.Min(min, v)
+		max = math.Max(max, v)
+	}
+	stats := []struct {
+		name  string
+		value float64
+	}{
+		{"sum", sum},
+		{"min", min},
+		{"max", max},
+		{"count", float64(len(values))},
+	}
+	if c.Debug {
+		level.Debug(c.logger).Log(
+			metric, "is an array of numbers, exporting its stats",
+		)
+	}
+	for _, stat := range stats {
+		if c.ScalarArrays == ScalarArraysLabel && metric == "" {
+			// A top-level array has no name of its own, name the
+			// metric after the subsystem instead.
+			c.addGauge(c.subsystem, "", labels.with("stat", stat.name), stat.value, c.subsystem)
+			continue
+		}
+		if c.ScalarArrays == ScalarArraysLabel {
+			c.addGauge(metric, c.subsystem, labels.with("stat", stat.name), stat.value, metric)
+			continue
+		}
+		name := stat.name
+		if metric != "" {
+			name = metric + c.Separator + stat.name
+		}
+		c.addGauge(name, c.subsystem, labels, stat.value, name)
+	}
+}
+
+// arrayLabelValue returns the value of the ArrayLabelKey field of an array
+// element, falling back to its position.
+func (c *GenericExporter) arrayLabelValue(index int, v interface{}) string {
+	if obj, ok := v.(map[string]interface{}); ok && c.ArrayLabelKey != "" {
+		switch id := obj[c.ArrayLabelKey].(type) {
+		case string:
+			return id
+		case json.Number:
+			return id.String()
+		case float64:
+			return strconv.FormatFloat(id, 'f', -1, 64)
+		}
+	}
+	return strconv.Itoa(index)
+}
+
+// Extract metrics from json array interface
+func (c *genericPath) extractJSONArray(metric string, depth int, labels metricLabels, jsonInt []interface{}) {
+	if c.exceedsMaxDepth(metric, depth) {
+		return
+	}
+	if depth > c.depthReached {
+		c.depthReached = depth
+	}
+	if c.ScalarArrays != ScalarArraysIndex {
+		if values, ok := c.scalarValues(jsonInt); ok {
+			c.addArrayStats(metric, labels, values)
+			return
+		}
+	}
+	newMetric := ""
+	label := c.ArrayLabel
+	if label == "" {
+		label = c.ArrayLabelKey
+	}
+	for k, v := range jsonInt {
+		elemLabels := labels
+		if label != "" && !labels.has(label) {
+			newMetric = metric
+			elemLabels = labels.with(label, c.arrayLabelValue(k, v))
+		} else if len(metric) > 0 {
+			newMetric = metric + c.Separator + strconv.Itoa(k)
+		} else {
+			newMetric = strconv.Itoa(k)
+		}
+		c.emitValue(newMetric, depth, elemLabels, v)
+	}
+}
@@ -0,0 +1,3125 @@
+package collector
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func gaugeValue(t *testing.T, g prometheus.Gauge) float64 {
+	var m dto.Metric
+	if err := g.Write(&m); err != nil {
+		t.Fatalf("Failed to write gauge: %s", err)
+	}
+	return m.GetGauge().GetValue()
+}
+
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		t.Fatalf("Failed to write counter: %s", err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+// newTestURL starts a server with handler for the duration of the test and
+// returns its URL.
+func newTestURL(t *testing.T, handler http.Handler) *url.URL {
+	ts := httptest.NewServer(handler)
+	t.Cleanup(ts.Close)
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatalf("Failed to parse URL: %s", err)
+	}
+	return u
+}
+
+// newTestExporter creates a generic query of _cluster/health against a server
+// answering it with body and the root endpoint with the cluster name
+// elasticsearch.
+func newTestExporter(t *testing.T, body string, opts ...Option) *GenericExporter {
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			fmt.Fprintln(w, `{"cluster_name":"elasticsearch"}`)
+			return
+		}
+		fmt.Fprintln(w, body)
+	}))
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"}, opts...)
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+	return c
+}
+
+func TestGenericQueryNamespace(t *testing.T) {
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprintln(w, `{"cluster_name":"elasticsearch"}`)
+		default:
+			fmt.Fprintln(w, `{"status":"green","number_of_nodes":1}`)
+		}
+	}))
+
+	tcs := map[string]string{
+		"":           "elasticsearch_cluster_health_",
+		"es_generic": "es_generic_cluster_health_",
+	}
+	for ns, prefix := range tcs {
+		c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"}, WithNamespace(ns))
+		if err != nil {
+			t.Fatalf("Failed to create generic query: %s", err)
+		}
+
+		ch := make(chan prometheus.Metric, 100)
+		c.Collect(ch)
+		close(ch)
+
+		var n int
+		for m := range ch {
+			n++
+			if desc := m.Desc().String(); !strings.Contains(desc, `fqName: "`+prefix) {
+				t.Errorf("[%s] metric %s isn't prefixed with %s", ns, desc, prefix)
+			}
+		}
+		if n == 0 {
+			t.Errorf("[%s] no metrics collected", ns)
+		}
+	}
+}
+
+func TestGenericQuerySelfMetricHelp(t *testing.T) {
+	u, err := url.Parse("http://localhost:9200")
+	if err != nil {
+		t.Fatalf("Failed to parse URL: %s", err)
+	}
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_nodes/stats", "_cluster/health"}, WithClusterNameOverride("elasticsearch"))
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+	registry, err := NewRegistry(c)
+	if err != nil {
+		t.Fatalf("Failed to register generic query: %s", err)
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Failed to gather metrics: %s", err)
+	}
+	help := make(map[string]string)
+	for _, mf := range families {
+		help[mf.GetName()] = mf.GetHelp()
+	}
+	for _, p := range c.paths {
+		name := prometheus.BuildFQName(c.Namespace, p.subsystem, "up")
+		if want := "Was the last scrape of " + p.URI_path + " successful."; help[name] != want {
+			t.Errorf("Expected the help %q of %s, got %q", want, name, help[name])
+		}
+	}
+}
+
+func TestGenericQueryHelp(t *testing.T) {
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"number_of_nodes":1,"Active_Shards":2}`)
+	}))
+	help := map[string]string{
+		"number_of_nodes": "Number of nodes in the cluster.",
+		"active_shards":   "Number of active shards.",
+	}
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"}, WithHelp(help))
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	for m, want := range help {
+		g, ok := c.paths[0].gauges[m]
+		if !ok {
+			t.Errorf("%s wasn't exported", m)
+			continue
+		}
+		if desc := g.WithLabelValues("").Desc().String(); !strings.Contains(desc, fmt.Sprintf("help: %q", want)) {
+			t.Errorf("Wrong help of %s: %s", m, desc)
+		}
+	}
+}
+
+func TestGenericQueryInvalidPath(t *testing.T) {
+	u, err := url.Parse("http://localhost:9200")
+	if err != nil {
+		t.Fatalf("Failed to parse URL: %s", err)
+	}
+	for _, path := range []string{"", "/", "?pretty", " ", "_cluster/health-check", "_nodes/stats/*"} {
+		if _, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{path}); err == nil {
+			t.Errorf("Expected an error for the URI path %q", path)
+		}
+	}
+	if err := (&GenericExporter{Namespace: namespace, Subsystems: map[string]string{"_cluster/health-check": "health_check"}}).validatePath("_cluster/health-check"); err != nil {
+		t.Errorf("Expected an explicit subsystem to be accepted, got %s", err)
+	}
+}
+
+func TestGetSubsystem(t *testing.T) {
+	tcs := map[string]string{
+		"_cluster/health":               "cluster_health",
+		"/_nodes/stats":                 "nodes_stats",
+		"_cat/indices":                  "cat_indices",
+		"twitter/_stats":                "twitter_stats",
+		"_cluster/health/":              "cluster_health",
+		"_cluster/health?level=indices": "cluster_health",
+		"/_nodes/stats/?human":          "nodes_stats",
+	}
+	for path, want := range tcs {
+		if got := GetSubsystem(path); got != want {
+			t.Errorf("GetSubsystem(%q) = %q; want %q", path, got, want)
+		}
+	}
+}
+
+func TestGenericQueryQueryString(t *testing.T) {
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_cluster/health" || r.URL.Query().Get("level") != "indices" {
+			fmt.Fprintln(w, `{}`)
+			return
+		}
+		fmt.Fprintln(w, `{"number_of_nodes":1}`)
+	}))
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health?level=indices"})
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	if _, ok := c.paths[0].gauges["number_of_nodes"]; !ok {
+		t.Errorf("number_of_nodes wasn't exported")
+	}
+}
+
+func TestGenericQueryRawQuery(t *testing.T) {
+	var rawQuery string
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			fmt.Fprintln(w, `{"cluster_name":"elasticsearch"}`)
+			return
+		}
+		rawQuery = r.URL.RawQuery
+		fmt.Fprintln(w, `[]`)
+	}))
+	tcs := map[string]string{
+		"_cat/indices?v&h=index,docs.count": "v&h=index,docs.count&format=json",
+		"_cat/indices":                      "format=json",
+		"_cat/indices?format=json&v":        "format=json&v",
+		"_cluster/health?v&level=indices":   "v&level=indices",
+	}
+	for path, want := range tcs {
+		c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{path}, WithSubsystem(path, "test"))
+		if err != nil {
+			t.Fatalf("Failed to create generic query: %s", err)
+		}
+
+		ch := make(chan prometheus.Metric, 100)
+		c.Collect(ch)
+		close(ch)
+		if rawQuery != want {
+			t.Errorf("[%s] Expected the query string %q, got %q", path, want, rawQuery)
+		}
+	}
+}
+
+func TestGenericQueryDateMathPath(t *testing.T) {
+	var requestURI string
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			fmt.Fprintln(w, `{"cluster_name":"elasticsearch"}`)
+			return
+		}
+		requestURI = r.RequestURI
+		fmt.Fprintln(w, `{"_shards":{"total":1}}`)
+	}))
+	path := "<logs-{now/d}>,<logs-{now/d-1d}>/_stats?level=indices"
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{path}, WithSubsystem(path, "logs_stats"))
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	if want := "/%3Clogs-%7Bnow%2Fd%7D%3E,%3Clogs-%7Bnow%2Fd-1d%7D%3E/_stats?level=indices"; requestURI != want {
+		t.Errorf("Expected the request URI %s, got %s", want, requestURI)
+	}
+	if _, ok := c.paths[0].gauges["shards_total"]; !ok {
+		t.Errorf("shards_total wasn't exported")
+	}
+}
+
+func TestGenericQueryReservedCharacters(t *testing.T) {
+	var requestURI string
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			fmt.Fprintln(w, `{"cluster_name":"elasticsearch"}`)
+			return
+		}
+		requestURI = r.RequestURI
+		fmt.Fprintln(w, `{"count":1}`)
+	}))
+	path := "my index%/_count?q=user:kimchy doe"
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{path}, WithSubsystem(path, "count"))
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	if want := "/my%20index%25/_count?q=user%3Akimchy+doe"; requestURI != want {
+		t.Errorf("Expected the request URI %s, got %s", want, requestURI)
+	}
+	if v := gaugeValue(t, c.paths[0].up); v != 1 {
+		t.Errorf("Expected up to be 1, got %v", v)
+	}
+
+	if _, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_count?q=100%"}); err == nil {
+		t.Errorf("Expected an error for an invalid query string")
+	}
+}
+
+func TestEscapePath(t *testing.T) {
+	tcs := map[string]string{
+		"_cluster/health":          "_cluster/health",
+		"/index1,index2/_stats":    "/index1,index2/_stats",
+		"<logs-{now/d}>/_stats":    "%3Clogs-%7Bnow%2Fd%7D%3E/_stats",
+		"/<logs-{now/M{yyyy.MM}}>": "/%3Clogs-%7Bnow%2FM%7Byyyy.MM%7D%7D%3E",
+		"/<unterminated/_stats":    "/%3Cunterminated%2F_stats",
+		"/my index/_stats":         "/my%20index/_stats",
+		"/100%/_doc/a#b":           "/100%25/_doc/a%23b",
+	}
+	for in, want := range tcs {
+		if got := escapePath(in); got != want {
+			t.Errorf("escapePath(%q) = %q; want %q", in, got, want)
+		}
+	}
+}
+
+func TestGenericQuerySubsystem(t *testing.T) {
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"number_of_nodes":1}`)
+	}))
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_nodes/stats", "_cluster/health"}, WithSubsystem("_nodes/stats", "hot_nodes"))
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+	if s := c.paths[0].subsystem; s != "hot_nodes" {
+		t.Errorf("Expected the subsystem hot_nodes, got %q", s)
+	}
+	if s := c.paths[1].subsystem; s != "cluster_health" {
+		t.Errorf("Expected the subsystem cluster_health, got %q", s)
+	}
+
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	if desc := c.paths[0].up.Desc().String(); !strings.Contains(desc, `fqName: "elasticsearch_hot_nodes_up"`) {
+		t.Errorf("Wrong name of the up metric: %s", desc)
+	}
+
+	_, err = NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_nodes/stats", "_cluster/health"}, WithSubsystem("_nodes/stats", "cluster_health"))
+	if err == nil {
+		t.Errorf("Expected an error for paths sharing a subsystem")
+	}
+}
+
+func TestGenericQueryBasicAuth(t *testing.T) {
+	ts := httptest.NewServer(&basicAuth{
+		User: "elastic",
+		Pass: "changeme",
+		Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/":
+				fmt.Fprintln(w, `{"cluster_name":"elasticsearch"}`)
+			default:
+				fmt.Fprintln(w, `{"number_of_nodes":1}`)
+			}
+		}),
+	})
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatalf("Failed to parse URL: %s", err)
+	}
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"}, WithBasicAuth("elastic", "changeme"))
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+	if c.ClusterName != "elasticsearch" {
+		t.Errorf("Wrong cluster name %q", c.ClusterName)
+	}
+
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	if _, ok := c.paths[0].gauges["number_of_nodes"]; !ok {
+		t.Errorf("number_of_nodes wasn't exported")
+	}
+}
+
+func TestGenericQueryBearerToken(t *testing.T) {
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer s3cr3t" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprintln(w, `{"cluster_name":"elasticsearch"}`)
+		default:
+			fmt.Fprintln(w, `{"number_of_nodes":1}`)
+		}
+	}))
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"}, WithBearerToken("s3cr3t"))
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+	if c.ClusterName != "elasticsearch" {
+		t.Errorf("Wrong cluster name %q", c.ClusterName)
+	}
+
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	if _, ok := c.paths[0].gauges["number_of_nodes"]; !ok {
+		t.Errorf("number_of_nodes wasn't exported")
+	}
+}
+
+func TestGenericQueryAPIKey(t *testing.T) {
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "ApiKey a2V5OnNlY3JldA==" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintln(w, `{"cluster_name":"elasticsearch"}`)
+	}))
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"}, WithAPIKey("a2V5OnNlY3JldA=="))
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+	if c.ClusterName != "elasticsearch" {
+		t.Errorf("Wrong cluster name %q", c.ClusterName)
+	}
+
+	_, err = NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"},
+		WithAPIKey("a2V5OnNlY3JldA=="),
+		WithBasicAuth("elastic", "changeme"),
+	)
+	if err == nil {
+		t.Errorf("Expected an error when combining API key and basic auth")
+	}
+
+	for _, opt := range []Option{WithBearerToken("secret"), WithBearerTokenFile("/nonexistent")} {
+		_, err = NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"}, opt, WithBasicAuth("elastic", "changeme"))
+		if err == nil {
+			t.Errorf("Expected an error when combining a bearer token and basic auth")
+		}
+	}
+}
+
+func TestGenericQueryCAFile(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"cluster_name":"elasticsearch"}`)
+	}))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatalf("Failed to parse URL: %s", err)
+	}
+
+	f, err := ioutil.TempFile("", "ca")
+	if err != nil {
+		t.Fatalf("Failed to create CA file: %s", err)
+	}
+	defer os.Remove(f.Name())
+	pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	f.Close()
+
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"}, WithCAFile(f.Name()))
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+	if c.ClusterName != "elasticsearch" {
+		t.Errorf("Wrong cluster name %q", c.ClusterName)
+	}
+
+	_, err = NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"}, WithCAFile(f.Name()+".missing"))
+	if err == nil {
+		t.Errorf("Expected an error for a missing CA file")
+	}
+}
+
+func TestGenericQueryInsecureSkipVerify(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"cluster_name":"elasticsearch"}`)
+	}))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatalf("Failed to parse URL: %s", err)
+	}
+
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"})
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+	if c.ClusterName != "" {
+		t.Errorf("Expected certificate verification to fail")
+	}
+
+	c, err = NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"}, WithInsecureSkipVerify(true))
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+	if c.ClusterName != "elasticsearch" {
+		t.Errorf("Wrong cluster name %q", c.ClusterName)
+	}
+}
+
+func TestGenericQueryClusterInfoURL(t *testing.T) {
+	u, err := url.Parse("http://127.0.0.1:1/_cluster/health?pretty")
+	if err != nil {
+		t.Fatalf("Failed to parse URL: %s", err)
+	}
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"})
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+	if got := u.String(); got != "http://127.0.0.1:1/_cluster/health?pretty" {
+		t.Errorf("The URL was modified to %s", got)
+	}
+
+	_, err = c.GetClusterName()
+	if err == nil || !strings.Contains(err.Error(), "from http://127.0.0.1:1:") {
+		t.Errorf("Expected the probed URL in the error, got %v", err)
+	}
+}
+
+func TestGenericQueryClusterInfoErrors(t *testing.T) {
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `not json`)
+	}))
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"})
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+
+	_, err = c.GetClusterName()
+	var syntaxErr *json.SyntaxError
+	if !errors.As(err, &syntaxErr) {
+		t.Errorf("Expected a wrapped JSON syntax error, got %v", err)
+	}
+
+	_, err = NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"}, WithCAFile("does-not-exist.pem"))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected a wrapped not exist error, got %v", err)
+	}
+}
+
+func TestGenericQueryClusterInfoErrorURL(t *testing.T) {
+	for _, target := range []string{"http://[::1]:1", "http://127.0.0.1:1/prefix?pretty"} {
+		u, err := url.Parse(target)
+		if err != nil {
+			t.Fatalf("Failed to parse URL: %s", err)
+		}
+		c := &GenericExporter{logger: log.NewNopLogger(), client: http.DefaultClient, url: u}
+		_, err = c.fetchClusterInfo(context.Background(), 0)
+		if err == nil {
+			t.Fatalf("[%s] Expected an error", target)
+		}
+		u.Path, u.RawQuery = "", ""
+		if !strings.Contains(err.Error(), " "+u.String()+":") {
+			t.Errorf("[%s] Error doesn't name the root endpoint %s: %s", target, u, err)
+		}
+	}
+}
+
+func TestGenericQueryClusterNameRetries(t *testing.T) {
+	attempts := 0
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, `{"cluster_name":"elasticsearch"}`)
+	}))
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"}, WithRetries(1, time.Millisecond), WithStrictClusterName(true))
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+	if c.ClusterName != "elasticsearch" {
+		t.Errorf("Wrong cluster name %q", c.ClusterName)
+	}
+
+	attempts = 0
+	_, err = NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"}, WithStrictClusterName(true))
+	if err == nil {
+		t.Errorf("Expected an error in strict mode")
+	}
+	if attempts != 1 {
+		t.Errorf("Expected a single request without retries, got %d", attempts)
+	}
+}
+
+func TestGenericQueryClusterNameResolved(t *testing.T) {
+	available := false
+	var rootRequests int
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			rootRequests++
+			if !available {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprintln(w, `{"cluster_name":"elasticsearch"}`)
+			return
+		}
+		fmt.Fprintln(w, `{"number_of_nodes":1}`)
+	}))
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"})
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+	if v := gaugeValue(t, c.paths[0].clusterNameResolved); v != 0 {
+		t.Errorf("Expected the cluster name to be unresolved, got %v", v)
+	}
+
+	rootRequests = 0
+	for i := 0; i < 3; i++ {
+		ch := make(chan prometheus.Metric, 100)
+		c.Collect(ch)
+		close(ch)
+	}
+	if rootRequests != 1 {
+		t.Errorf("Expected the cluster name to be retried once, got %d requests", rootRequests)
+	}
+
+	available = true
+	c.clusterNameRetryAt = time.Time{}
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	if v := gaugeValue(t, c.paths[0].clusterNameResolved); v != 1 {
+		t.Errorf("Expected the cluster name to be resolved, got %v", v)
+	}
+	if c.ClusterName != "elasticsearch" {
+		t.Errorf("Wrong cluster name %q", c.ClusterName)
+	}
+	g, ok := c.paths[0].gauges["number_of_nodes"]
+	if !ok {
+		t.Fatalf("number_of_nodes wasn't exported")
+	}
+	if v := gaugeValue(t, g.WithLabelValues("elasticsearch")); v != 1 {
+		t.Errorf("Expected 1 for the resolved cluster name, got %v", v)
+	}
+}
+
+func TestNewGenericQueryConfig(t *testing.T) {
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			fmt.Fprintln(w, `{"cluster_name":"elasticsearch"}`)
+			return
+		}
+		fmt.Fprintln(w, `{"number_of_nodes":1}`)
+	}))
+	c, err := NewGenericQueryConfig(Config{
+		Logger:   log.NewNopLogger(),
+		Client:   http.DefaultClient,
+		URL:      u,
+		URIPaths: []string{"_cluster/health"},
+		Options:  []Option{WithNamespace("es")},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+	if c.Namespace != "es" || c.ClusterName != "elasticsearch" {
+		t.Errorf("Unexpected namespace %q or cluster name %q", c.Namespace, c.ClusterName)
+	}
+
+	if _, err := NewGenericQueryConfig(Config{Logger: log.NewNopLogger(), Client: http.DefaultClient, URL: u}); err == nil {
+		t.Errorf("Expected an error without URI paths")
+	}
+
+	c, err = NewGenericQueryConfig(Config{
+		Logger:       log.NewNopLogger(),
+		Client:       http.DefaultClient,
+		URL:          u,
+		URIPaths:     []string{"_cluster/health"},
+		Namespace:    "es",
+		Username:     "elastic",
+		Password:     "secret",
+		Timeout:      time.Second,
+		ClusterLabel: "es_cluster",
+		StaticLabels: map[string]string{"datacenter": "eu1"},
+		Options:      []Option{WithNamespace("search")},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+	if c.Username != "elastic" || c.Password != "secret" || c.Timeout != time.Second {
+		t.Errorf("Unexpected credentials %q:%q or timeout %s", c.Username, c.Password, c.Timeout)
+	}
+	if c.ClusterLabel != "es_cluster" || c.StaticLabels["datacenter"] != "eu1" {
+		t.Errorf("Unexpected cluster label %q or static labels %v", c.ClusterLabel, c.StaticLabels)
+	}
+	if c.Namespace != "search" {
+		t.Errorf("Expected the options to take precedence over the fields, got namespace %q", c.Namespace)
+	}
+}
+
+func TestGenericQueryClusterNameOverride(t *testing.T) {
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			t.Errorf("The cluster name was queried despite the override")
+		}
+		fmt.Fprintln(w, `{"number_of_nodes":1}`)
+	}))
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"}, WithClusterNameOverride("prod"), WithStrictClusterName(true))
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+	if name, err := c.GetClusterName(); name != "prod" || err != nil {
+		t.Errorf("Expected the cluster name prod, got %q, %v", name, err)
+	}
+
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	g, ok := c.paths[0].gauges["number_of_nodes"]
+	if !ok {
+		t.Fatalf("number_of_nodes wasn't exported")
+	}
+	if v := gaugeValue(t, g.WithLabelValues("prod")); v != 1 {
+		t.Errorf("Expected 1 for cluster prod, got %v", v)
+	}
+}
+
+func TestGenericQueryNodeLabels(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			fmt.Fprintln(w, `{"cluster_name":"elasticsearch"}`)
+			return
+		}
+		fmt.Fprintln(w, `{"nodes":{"AbC123":{"roles":["master","data"],"attributes":{"box_type":"hot"},"jvm":{"uptime_in_millis":1}},"DeF456":{"roles":["ingest"],"jvm":{"uptime_in_millis":2}}}}`)
+	}))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatalf("Failed to parse URL: %s", err)
+	}
+	opts := []Option{WithNodeRolesLabel(true), WithNodeAttributeLabel("box_type", "box_type")}
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_nodes/stats"}, append(opts, WithLabelKey("nodes", "node"))...)
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	g, ok := c.paths[0].gauges["nodes_jvm_uptime_in_millis"]
+	if !ok {
+		t.Fatalf("nodes_jvm_uptime_in_millis wasn't exported")
+	}
+	if v := gaugeValue(t, g.WithLabelValues("elasticsearch", "data,master", "hot", "AbC123")); v != 1 {
+		t.Errorf("Expected 1 for node AbC123, got %v", v)
+	}
+	if v := gaugeValue(t, g.WithLabelValues("elasticsearch", "ingest", "", "DeF456")); v != 2 {
+		t.Errorf("Expected 2 for node DeF456, got %v", v)
+	}
+
+	c, err = NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_nodes/stats"}, opts...)
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+	ch = make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	g, ok = c.paths[0].gauges["nodes_abc123_jvm_uptime_in_millis"]
+	if !ok {
+		t.Fatalf("nodes_abc123_jvm_uptime_in_millis wasn't exported")
+	}
+	if v := gaugeValue(t, g.WithLabelValues("elasticsearch", "data,master", "hot")); v != 1 {
+		t.Errorf("Expected 1 for node AbC123, got %v", v)
+	}
+
+	if _, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_nodes/stats"}, WithNodeRolesLabel(true), WithNodeAttributeLabel("box_type", "roles")); err == nil {
+		t.Errorf("Expected an error for an attribute label conflicting with the roles label")
+	}
+	for _, opts := range [][]Option{
+		{WithNodeRolesLabel(true), WithStaticLabels(map[string]string{"roles": "x"})},
+		{WithNodeRolesLabel(true), WithLabelKey("nodes", "roles")},
+		{WithNodeAttributeLabel("box_type", "zone"), WithArrayLabel("zone")},
+		{WithNodeAttributeLabel("box_type", "zone"), WithStaticLabels(map[string]string{"zone": "x"})},
+		{WithNodeAttributeLabel("box_type", "zone"), WithNodeAttributeLabel("rack", "zone")},
+	} {
+		if _, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_nodes/stats"}, opts...); err == nil {
+			t.Errorf("Expected an error for conflicting node labels")
+		}
+	}
+}
+
+func TestGenericQueryTasksLabel(t *testing.T) {
+	c := newTestExporter(t, `{"nodes":{
+			"AbC123":{"name":"es1","tasks":{"AbC123:17":{"node":"AbC123","id":17,"action":"indices:data/write/reindex","running_time_in_nanos":100,"cancellable":true}}},
+			"DeF456":{"name":"es2","tasks":{"DeF456:3":{"node":"DeF456","id":3,"action":"cluster:monitor/tasks/lists","running_time_in_nanos":5,"cancellable":false}}}
+		}}`, WithTasksLabel(true))
+
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	g, ok := c.paths[0].gauges["tasks_running_time_in_nanos"]
+	if !ok {
+		t.Fatalf("tasks_running_time_in_nanos wasn't exported, got %v", c.paths[0].labelNames)
+	}
+	if v := gaugeValue(t, g.WithLabelValues("elasticsearch", "AbC123:17", "indices:data/write/reindex", "AbC123")); v != 100 {
+		t.Errorf("Expected 100 for task AbC123:17, got %v", v)
+	}
+	if v := gaugeValue(t, g.WithLabelValues("elasticsearch", "DeF456:3", "cluster:monitor/tasks/lists", "DeF456")); v != 5 {
+		t.Errorf("Expected 5 for task DeF456:3, got %v", v)
+	}
+	for name := range c.paths[0].gauges {
+		if strings.Contains(name, "abc123") || strings.Contains(name, "def456") {
+			t.Errorf("Task id flattened into metric name %s", name)
+		}
+	}
+	for _, opts := range [][]Option{
+		{WithTasksLabel(true), WithStaticLabels(map[string]string{"action": "x"})},
+		{WithTasksLabel(true), WithLabelKey("tasks", "task")},
+		{WithTasksLabel(true), WithArrayLabel("node")},
+		{WithTasksLabel(true), WithClusterLabel("task")},
+	} {
+		if _, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, c.url, []string{"_tasks"}, opts...); err == nil {
+			t.Errorf("Expected an error for conflicting task labels")
+		}
+	}
+	if _, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, c.url, []string{"_tasks"}, WithTasksLabel(true), WithLabelKey("nodes", "node")); err != nil {
+		t.Errorf("Expected a label key to be able to add the node label, got %s", err)
+	}
+}
+
+func TestGenericQueryShardLabels(t *testing.T) {
+	c := newTestExporter(t, `{"indices":{"logs":{"primaries":{"docs":{"count":3}},"shards":{
+			"0":[{"routing":{"state":"STARTED","primary":true,"node":"AbC123"},"docs":{"count":1}},{"routing":{"state":"STARTED","primary":false,"node":"DeF456"},"docs":{"count":1}}],
+			"1":[{"routing":{"state":"STARTED","primary":true,"node":"DeF456"},"docs":{"count":2}}]
+		}}}}`, WithShardLabels(true))
+
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	g, ok := c.paths[0].gauges["indices_shards_docs_count"]
+	if !ok {
+		t.Fatalf("indices_shards_docs_count wasn't exported, got %v", c.paths[0].labelNames)
+	}
+	for _, tc := range []struct {
+		shard, primary, node string
+		want                 float64
+	}{
+		{"0", "true", "AbC123", 1},
+		{"0", "false", "DeF456", 1},
+		{"1", "true", "DeF456", 2},
+	} {
+		if v := gaugeValue(t, g.WithLabelValues("elasticsearch", "logs", tc.shard, tc.primary, tc.node)); v != tc.want {
+			t.Errorf("Expected %v for shard %s on %s, got %v", tc.want, tc.shard, tc.node, v)
+		}
+	}
+	if _, ok := c.paths[0].gauges["indices_primaries_docs_count"]; !ok {
+		t.Errorf("Expected the index stats with an index label")
+	}
+	for _, opts := range [][]Option{
+		{WithShardLabels(true), WithStaticLabels(map[string]string{"primary": "x"})},
+		{WithShardLabels(true), WithLabelKey("shards", "shard")},
+		{WithShardLabels(true), WithStaticLabels(map[string]string{"node": "x"})},
+	} {
+		if _, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, c.url, []string{"_stats"}, opts...); err == nil {
+			t.Errorf("Expected an error for conflicting shard labels")
+		}
+	}
+
+	for _, tc := range []struct {
+		opts  []Option
+		index bool
+	}{
+		{[]Option{WithShardLabels(true), WithShardLabels(false)}, false},
+		{[]Option{WithIndexLabel(true), WithShardLabels(true), WithShardLabels(false)}, true},
+		{[]Option{WithShardLabels(true), WithIndexLabel(true), WithShardLabels(false)}, true},
+	} {
+		c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, c.url, []string{"_stats"}, tc.opts...)
+		if err != nil {
+			t.Fatalf("Failed to create generic query: %s", err)
+		}
+		if c.ShardLabels {
+			t.Errorf("Expected WithShardLabels(false) to disable the shard labels")
+		}
+		if _, ok := c.LabelKeys["indices"]; ok != tc.index {
+			t.Errorf("Expected the index label to be enabled: %v, got %v", tc.index, ok)
+		}
+	}
+}
+
+func TestGenericQueryBearerTokenFile(t *testing.T) {
+	var tokens []string
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokens = append(tokens, r.Header.Get("Authorization"))
+		fmt.Fprintln(w, `{"cluster_name":"elasticsearch"}`)
+	}))
+	f, err := ioutil.TempFile("", "token")
+	if err != nil {
+		t.Fatalf("Failed to create token file: %s", err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprintln(f, "first")
+	f.Close()
+
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"}, WithBearerTokenFile(f.Name()))
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+	scrape := func() {
+		ch := make(chan prometheus.Metric, 100)
+		c.Collect(ch)
+		close(ch)
+	}
+	if err := ioutil.WriteFile(f.Name(), []byte("second\n"), 0600); err != nil {
+		t.Fatalf("Failed to rotate token file: %s", err)
+	}
+	scrape()
+	c.tokenReadAt = time.Time{}
+	scrape()
+	os.Remove(f.Name())
+	c.tokenReadAt = time.Time{}
+	scrape()
+
+	want := []string{"Bearer first", "Bearer first", "Bearer second", "Bearer second"}
+	if !equalStrings(tokens, want) {
+		t.Errorf("Expected the tokens %v, got %v", want, tokens)
+	}
+
+	if _, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"}, WithBearerTokenFile(f.Name())); err == nil {
+		t.Errorf("Expected an error for a missing token file")
+	}
+	if _, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"}, WithBearerTokenFile(f.Name()), WithBearerToken("static")); err == nil {
+		t.Errorf("Expected an error for both a bearer token and a token file")
+	}
+}
+
+func TestGenericQueryHeaders(t *testing.T) {
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := r.Header.Get("X-Opaque-Id"); id != "exporter" {
+			t.Errorf("[%s] Expected the X-Opaque-Id header exporter, got %q", r.URL.Path, id)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "ApiKey secret" {
+			t.Errorf("[%s] Expected the API key to take precedence, got %q", r.URL.Path, auth)
+		}
+		if r.URL.Path == "/" {
+			fmt.Fprintln(w, `{"cluster_name":"elasticsearch"}`)
+			return
+		}
+		fmt.Fprintln(w, `{"number_of_nodes":1}`)
+	}))
+	headers := map[string]string{"X-Opaque-Id": "exporter", "Authorization": "Basic other"}
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"}, WithHeaders(headers), WithAPIKey("secret"))
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	if v := gaugeValue(t, c.paths[0].up); v != 1 {
+		t.Errorf("Expected up to be 1, got %v", v)
+	}
+}
+
+func TestGenericQueryUserAgent(t *testing.T) {
+	var agents []string
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agents = append(agents, r.UserAgent())
+		fmt.Fprintln(w, `{"status":1}`)
+	}))
+
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"})
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	if len(agents) == 0 {
+		t.Fatalf("Expected requests to the server")
+	}
+	for _, agent := range agents {
+		if agent != "elasticsearch_exporter" {
+			t.Errorf("Expected the default User-Agent, got %q", agent)
+		}
+	}
+
+	agents = nil
+	c, err = NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"}, WithUserAgent("monitoring/1.0"))
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+	ch = make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	if len(agents) == 0 {
+		t.Fatalf("Expected requests to the server")
+	}
+	for _, agent := range agents {
+		if agent != "monitoring/1.0" {
+			t.Errorf("Expected the configured User-Agent, got %q", agent)
+		}
+	}
+}
+
+func TestGenericQueryConnectionPool(t *testing.T) {
+	u, err := url.Parse("http://localhost:1")
+	if err != nil {
+		t.Fatalf("Failed to parse URL: %s", err)
+	}
+
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"},
+		WithMaxIdleConns(10), WithMaxIdleConnsPerHost(5), WithIdleConnTimeout(time.Minute))
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+	transport, ok := c.client.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("Expected a *http.Transport, got %T", c.client.Transport)
+	}
+	if transport.MaxIdleConns != 10 || transport.MaxIdleConnsPerHost != 5 || transport.IdleConnTimeout != time.Minute {
+		t.Errorf("Wrong connection pool settings %d, %d, %s", transport.MaxIdleConns, transport.MaxIdleConnsPerHost, transport.IdleConnTimeout)
+	}
+	if http.DefaultClient.Transport != nil {
+		t.Errorf("The shared client was modified")
+	}
+
+	_, err = NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"}, WithMaxIdleConns(-1))
+	if err == nil {
+		t.Errorf("Expected an error for a negative number of idle connections")
+	}
+}
+
+func TestGenericQueryUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "generic_query")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	socket := dir + "/es.sock"
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Failed to listen on %s: %s", socket, err)
+	}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"status":1}`)
+	}))
+	ts.Listener.Close()
+	ts.Listener = l
+	ts.Start()
+	defer ts.Close()
+
+	u, err := url.Parse("unix://" + socket)
+	if err != nil {
+		t.Fatalf("Failed to parse URL: %s", err)
+	}
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"})
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+	if c.UnixSocket != socket {
+		t.Errorf("Expected the socket %s, got %q", socket, c.UnixSocket)
+	}
+
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	if v := gaugeValue(t, c.paths[0].up); v != 1 {
+		t.Errorf("Expected up to be 1, got %v", v)
+	}
+	if http.DefaultClient.Transport != nil {
+		t.Errorf("The shared client was modified")
+	}
+}
+
+func TestGenericQueryStartupTimeout(t *testing.T) {
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer ts.Close()
+	defer close(done)
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatalf("Failed to parse URL: %s", err)
+	}
+	start := time.Now()
+	_, err = NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"},
+		WithStartupTimeout(50*time.Millisecond), WithStrictClusterName(true))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the cluster name query to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the startup to be bounded by the timeout, took %s", elapsed)
+	}
+}
+
+func TestGenericQueryNoStartupDelay(t *testing.T) {
+	// The startup jitter is slept by main, the constructor queries the
+	// cluster name right away.
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"cluster_name":"elasticsearch"}`)
+	}))
+	start := time.Now()
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"})
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected the generic query to be created without delay, took %s", elapsed)
+	}
+	if c.ClusterName != "elasticsearch" {
+		t.Errorf("Wrong cluster name %q", c.ClusterName)
+	}
+}
+
+func TestGenericQueryHTTP2(t *testing.T) {
+	var protos []int
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protos = append(protos, r.ProtoMajor)
+		fmt.Fprintln(w, `{"status":1}`)
+	}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatalf("Failed to parse URL: %s", err)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	for _, want := range []int{1, 2} {
+		protos = nil
+		c, err := NewGenericQuery(log.NewNopLogger(), client, u, []string{"_cluster/health"}, WithHTTP2(want == 2))
+		if err != nil {
+			t.Fatalf("Failed to create generic query: %s", err)
+		}
+		ch := make(chan prometheus.Metric, 100)
+		c.Collect(ch)
+		close(ch)
+		if len(protos) == 0 {
+			t.Fatalf("Expected requests to the server")
+		}
+		for _, proto := range protos {
+			if proto != want {
+				t.Errorf("Expected HTTP/%d, got HTTP/%d", want, proto)
+			}
+		}
+	}
+}
+
+func TestGenericQueryClientCert(t *testing.T) {
+	u, err := url.Parse("https://localhost:9200")
+	if err != nil {
+		t.Fatalf("Failed to parse URL: %s", err)
+	}
+
+	tcs := map[string][2]string{
+		"missing key":   {"client.crt", ""},
+		"missing cert":  {"", "client.key"},
+		"missing files": {"does-not-exist.crt", "does-not-exist.key"},
+	}
+	for name, tc := range tcs {
+		_, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"}, WithClientCert(tc[0], tc[1]))
+		if err == nil {
+			t.Errorf("[%s] Expected an error loading the client certificate", name)
+		}
+	}
+}
+
+func TestGenericQueryTimeout(t *testing.T) {
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		fmt.Fprintln(w, `{"cluster_name":"elasticsearch"}`)
+	}))
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"}, WithTimeout(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	if len(ch) != 19 {
+		t.Errorf("Expected only the 19 self metrics, got %d", len(ch))
+	}
+	if v := gaugeValue(t, c.paths[0].scrapeDuration); v < 0.01 {
+		t.Errorf("Expected the scrape duration to include the timeout, got %v", v)
+	}
+	if v := gaugeValue(t, c.paths[0].up); v != 0 {
+		t.Errorf("Expected up to be 0 after a timeout, got %v", v)
+	}
+	if v := gaugeValue(t, c.paths[0].statusCode); v != 0 {
+		t.Errorf("Expected a status code of 0 after a timeout, got %v", v)
+	}
+}
+
+func TestGenericQueryLastScrapeTimestamp(t *testing.T) {
+	fail := false
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail && r.URL.Path != "/" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		fmt.Fprintln(w, `{"number_of_nodes":1}`)
+	}))
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"})
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+
+	before := float64(time.Now().Unix())
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	last := gaugeValue(t, c.paths[0].lastScrapeTimestamp)
+	if last < before {
+		t.Errorf("Expected the last scrape timestamp to be at least %v, got %v", before, last)
+	}
+	if v := gaugeValue(t, c.paths[0].statusCode); v != http.StatusOK {
+		t.Errorf("Expected a status code of 200, got %v", v)
+	}
+	if v := gaugeValue(t, c.paths[0].responseBytes); v != float64(len(`{"number_of_nodes":1}`)+1) {
+		t.Errorf("Expected the size of the response body, got %v", v)
+	}
+
+	ch = make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	if v := counterValue(t, c.paths[0].responseBytesTotal); v != float64(2*len(`{"number_of_nodes":1}`)+2) {
+		t.Errorf("Expected the total size of both response bodies, got %v", v)
+	}
+
+	fail = true
+	ch = make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	if v := gaugeValue(t, c.paths[0].lastScrapeTimestamp); v != last {
+		t.Errorf("Expected a failed scrape to keep the timestamp %v, got %v", last, v)
+	}
+}
+
+func TestGenericQueryContext(t *testing.T) {
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		fmt.Fprintln(w, `{"cluster_name":"elasticsearch"}`)
+	}))
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"})
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.SetContext(ctx)
+
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	if v := gaugeValue(t, c.paths[0].up); v != 0 {
+		t.Errorf("Expected up to be 0 for a cancelled scrape, got %v", v)
+	}
+}
+
+func TestGenericQueryConcurrentScrapes(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_cluster/health" {
+			once.Do(func() {
+				close(started)
+				<-release
+			})
+		}
+		fmt.Fprintln(w, `{"cluster_name":"elasticsearch","number_of_nodes":1}`)
+	}))
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health", "_cluster/stats"})
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+	handler, err := Handler(log.NewNopLogger(), c)
+	if err != nil {
+		t.Fatalf("Failed to create handler: %s", err)
+	}
+
+	first := httptest.NewRecorder()
+	firstDone := make(chan struct{})
+	go func() {
+		defer close(firstDone)
+		handler.ServeHTTP(first, httptest.NewRequest("GET", "/metrics", nil))
+	}()
+	<-started
+
+	// A second scrape whose client goes away while the first one is running
+	// must not cancel the remaining paths of the first one.
+	ctx, cancel := context.WithCancel(context.Background())
+	secondDone := make(chan struct{})
+	go func() {
+		defer close(secondDone)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil).WithContext(ctx))
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	close(release)
+	<-firstDone
+	<-secondDone
+
+	want := `elasticsearch_cluster_stats_up{path="_cluster/stats",subsystem="cluster_stats"} 1`
+	if !strings.Contains(first.Body.String(), want) {
+		t.Errorf("Expected %q in the metrics of the first scrape:\n%s", want, first.Body.String())
+	}
+}
+
+func TestGenericQueryRetries(t *testing.T) {
+	var failures int
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" && failures < 2 {
+			failures++
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, `{"number_of_nodes":1}`)
+	}))
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"}, WithRetries(2, time.Millisecond))
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	if failures != 2 {
+		t.Errorf("Expected 2 failed attempts, got %d", failures)
+	}
+
+	if _, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"}, WithRetries(-1, 0)); err == nil {
+		t.Errorf("Expected an error for negative retries")
+	}
+	if v := gaugeValue(t, c.paths[0].up); v != 1 {
+		t.Errorf("Expected up to be 1 after retrying, got %v", v)
+	}
+}
+
+func TestGenericQueryStaleGauges(t *testing.T) {
+	bodies := []string{
+		`{"indices":{"a":{"docs":1},"b":{"docs":2}}}`,
+		`{"indices":{"a":{"docs":3}}}`,
+	}
+	var scrape int
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			fmt.Fprintln(w, `{"cluster_name":"elasticsearch"}`)
+			return
+		}
+		fmt.Fprintln(w, bodies[scrape])
+		scrape++
+	}))
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_stats"})
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+
+	for i, want := range []int{2, 1} {
+		ch := make(chan prometheus.Metric, 100)
+		c.Collect(ch)
+		close(ch)
+		if len(c.paths[0].gauges) != want {
+			t.Errorf("[scrape %d] Expected %d gauges, got %d", i, want, len(c.paths[0].gauges))
+		}
+		if v := gaugeValue(t, c.paths[0].seriesCount); v != float64(want) {
+			t.Errorf("[scrape %d] Expected a series count of %d, got %v", i, want, v)
+		}
+	}
+	if _, ok := c.paths[0].gauges["indices_b_docs"]; ok {
+		t.Errorf("Stale gauge indices_b_docs wasn't removed")
+	}
+}
+
+func TestGenericQueryRegisteredGauges(t *testing.T) {
+	c := newTestExporter(t, `{"docs":{"count":1,"deleted":2},"indexing":{"index_total":3}}`, WithCounters(regexp.MustCompile(`_total$`)))
+
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	if v := gaugeValue(t, c.paths[0].registeredGauges); v != 2 {
+		t.Errorf("Expected 2 registered gauges, got %v", v)
+	}
+	if v := gaugeValue(t, c.paths[0].seriesCount); v != 3 {
+		t.Errorf("Expected a series count of 3, got %v", v)
+	}
+}
+
+func TestGenericQueryScalarArrays(t *testing.T) {
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"cluster_name":"elasticsearch","load":[1,4,2.5],"roles":["data","master"]}`)
+	}))
+	want := map[string]float64{"sum": 7.5, "min": 1, "max": 4, "count": 3}
+
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_nodes/stats"}, WithScalarArrays(ScalarArraysSuffix))
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	for stat, v := range want {
+		g, ok := c.paths[0].gauges["load_"+stat]
+		if !ok {
+			t.Errorf("load_%s wasn't exported", stat)
+			continue
+		}
+		if got := gaugeValue(t, g.WithLabelValues("elasticsearch")); got != v {
+			t.Errorf("Expected load_%s to be %v, got %v", stat, v, got)
+		}
+	}
+	if _, ok := c.paths[0].gauges["load_0"]; ok {
+		t.Errorf("Expected no per element gauges")
+	}
+
+	c, err = NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_nodes/stats"}, WithScalarArrays(ScalarArraysLabel))
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+	ch = make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	g, ok := c.paths[0].gauges["load"]
+	if !ok {
+		t.Fatalf("load wasn't exported")
+	}
+	for stat, v := range want {
+		if got := gaugeValue(t, g.WithLabelValues("elasticsearch", stat)); got != v {
+			t.Errorf("Expected load{stat=%q} to be %v, got %v", stat, v, got)
+		}
+	}
+
+	c, err = NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_nodes/stats"})
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+	ch = make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	if _, ok := c.paths[0].gauges["load_1"]; !ok {
+		t.Errorf("Expected per element gauges by default")
+	}
+
+	_, err = NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_nodes/stats"}, WithScalarArrays("median"))
+	if err == nil {
+		t.Errorf("Expected an error for an invalid scalar arrays mode")
+	}
+	for _, opts := range [][]Option{
+		{WithScalarArrays(ScalarArraysLabel), WithStaticLabels(map[string]string{"stat": "x"})},
+		{WithScalarArrays(ScalarArraysLabel), WithLabelKey("nodes", "stat")},
+		{WithScalarArrays(ScalarArraysLabel), WithArrayLabel("stat")},
+	} {
+		if _, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_nodes/stats"}, opts...); err == nil {
+			t.Errorf("Expected an error for a conflicting stat label")
+		}
+	}
+
+	c = newTestExporter(t, `[1,2,3]`, WithScalarArrays(ScalarArraysLabel))
+	ch = make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	if _, ok := c.paths[0].gauges[""]; ok {
+		t.Errorf("Expected no gauge without a name for a top-level array")
+	}
+	g, ok = c.paths[0].gauges["cluster_health"]
+	if !ok {
+		t.Fatalf("Expected a top-level array to be named after the subsystem")
+	}
+	if got := gaugeValue(t, g.WithLabelValues("elasticsearch", "sum")); got != 6 {
+		t.Errorf("Expected cluster_health{stat=\"sum\"} to be 6, got %v", got)
+	}
+	names, err := c.Preview()
+	if err != nil {
+		t.Fatalf("Failed to preview: %s", err)
+	}
+	if want := []string{"elasticsearch_cluster_health"}; !equalStrings(names, want) {
+		t.Errorf("Expected the preview %v, got %v", want, names)
+	}
+}
+
+func TestGenericQueryArrayUnits(t *testing.T) {
+	c := newTestExporter(t, `{"cluster_name":"elasticsearch","sizes":["1kb",2,"1.5s"]}`, WithByteUnits(1024), WithParseDurations(true))
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	for name, want := range map[string]float64{"sizes_0": 1024, "sizes_1": 2, "sizes_2_seconds": 1.5} {
+		g, ok := c.paths[0].gauges[name]
+		if !ok {
+			t.Errorf("%s wasn't exported", name)
+			continue
+		}
+		if v := gaugeValue(t, g.WithLabelValues("elasticsearch")); v != want {
+			t.Errorf("Expected %s to be %v, got %v", name, want, v)
+		}
+	}
+}
+
+func TestGenericQueryDropValueTypes(t *testing.T) {
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"cluster_name":"elasticsearch","status":"green","timed_out":false,"number_of_nodes":1,"load":[1,2]}`)
+	}))
+	for _, tc := range []struct {
+		opt  Option
+		want []string
+	}{
+		{WithDropBools(false), []string{"load_0", "load_1", "number_of_nodes", "status", "timed_out"}},
+		{WithDropBools(true), []string{"load_0", "load_1", "number_of_nodes", "status"}},
+		{WithDropNumbers(true), []string{"status", "timed_out"}},
+		{WithDropStrings(true), []string{"load_0", "load_1", "number_of_nodes", "timed_out"}},
+	} {
+		c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"}, tc.opt)
+		if err != nil {
+			t.Fatalf("Failed to create generic query: %s", err)
+		}
+		ch := make(chan prometheus.Metric, 100)
+		c.Collect(ch)
+		close(ch)
+		var names []string
+		for name := range c.paths[0].gauges {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if !equalStrings(names, tc.want) {
+			t.Errorf("Expected the gauges %v, got %v", tc.want, names)
+		}
+	}
+}
+
+func TestGenericQueryUpLabels(t *testing.T) {
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"cluster_name":"elasticsearch","status":"green"}`)
+	}))
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health?level=indices"})
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+
+	var m dto.Metric
+	if err := c.paths[0].up.Write(&m); err != nil {
+		t.Fatalf("Failed to write up: %s", err)
+	}
+	labels := make(map[string]string)
+	for _, l := range m.GetLabel() {
+		labels[l.GetName()] = l.GetValue()
+	}
+	if labels["path"] != "_cluster/health?level=indices" || labels["subsystem"] != c.paths[0].subsystem {
+		t.Errorf("Expected the path and subsystem labels on up, got %v", labels)
+	}
+
+	c.Collect(make(chan prometheus.Metric, 100))
+	if v := gaugeValue(t, c.paths[0].upVec.WithLabelValues("_cluster/health?level=indices", c.paths[0].subsystem)); v != 1 {
+		t.Errorf("Expected up of the path to be 1, got %v", v)
+	}
+}
+
+func TestGenericQueryReuseGauges(t *testing.T) {
+	c := newTestExporter(t, `{"number_of_nodes":1}`)
+
+	var first *prometheus.GaugeVec
+	for i := 0; i < 2; i++ {
+		ch := make(chan prometheus.Metric, 100)
+		c.Collect(ch)
+		close(ch)
+		g, ok := c.paths[0].gauges["number_of_nodes"]
+		if !ok {
+			t.Fatalf("number_of_nodes wasn't exported")
+		}
+		if first == nil {
+			first = g
+		} else if g != first {
+			t.Errorf("GaugeVec of number_of_nodes was reallocated")
+		}
+	}
+}
+
+func TestGenericQueryStatusCode(t *testing.T) {
+	for _, code := range []int{http.StatusNotFound, http.StatusInternalServerError} {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/" {
+				w.WriteHeader(code)
+			}
+			fmt.Fprintln(w, `{"number_of_nodes":1}`)
+		}))
+		defer ts.Close()
+
+		u, err := url.Parse(ts.URL)
+		if err != nil {
+			t.Fatalf("Failed to parse URL: %s", err)
+		}
+		c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"})
+		if err != nil {
+			t.Fatalf("Failed to create generic query: %s", err)
+		}
+
+		ch := make(chan prometheus.Metric, 100)
+		c.Collect(ch)
+		close(ch)
+		if v := gaugeValue(t, c.paths[0].up); v != 0 {
+			t.Errorf("[%d] Expected up to be 0, got %v", code, v)
+		}
+		if v := gaugeValue(t, c.paths[0].statusCode); v != float64(code) {
+			t.Errorf("[%d] Expected a status code of %d, got %v", code, code, v)
+		}
+		if len(c.paths[0].gauges) != 0 {
+			t.Errorf("[%d] Expected no gauges from an error response, got %d", code, len(c.paths[0].gauges))
+		}
+		if v := gaugeValue(t, c.paths[0].seriesCount); v != 0 {
+			t.Errorf("[%d] Expected a series count of 0, got %v", code, v)
+		}
+	}
+}
+
+func TestGenericQueryJSONParseFailures(t *testing.T) {
+	tcs := map[string]float64{
+		`{"number_of_nodes":1}`:  0,
+		`not json`:               1,
+		`{"settings":"{broken"}`: 1,
+		`{"nodes":["{broken","{broken"],"misc":"{bad"}`: 3,
+		`{"settings":"[broken","nodes":["[1,"]}`:        2,
+	}
+	for body, want := range tcs {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintln(w, body)
+		}))
+		defer ts.Close()
+
+		u, err := url.Parse(ts.URL)
+		if err != nil {
+			t.Fatalf("Failed to parse URL: %s", err)
+		}
+		c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"})
+		if err != nil {
+			t.Fatalf("Failed to create generic query: %s", err)
+		}
+
+		ch := make(chan prometheus.Metric, 100)
+		c.Collect(ch)
+		close(ch)
+		if v := counterValue(t, c.paths[0].jsonParseFailures); v != want {
+			t.Errorf("[%s] Expected %v JSON parse failures, got %v", body, want, v)
+		}
+	}
+}
+
+func TestGenericQueryEmbeddedJSONArray(t *testing.T) {
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"shards":"[{\"size\":1},{\"size\":2}]","nodes":["[3]"]}`)
+	}))
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"})
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	for m, want := range map[string]float64{"shards_0_size": 1, "shards_1_size": 2, "nodes_0_0": 3} {
+		g, ok := c.paths[0].gauges[m]
+		if !ok {
+			t.Errorf("%s wasn't exported", m)
+			continue
+		}
+		if v := gaugeValue(t, g.WithLabelValues("")); v != want {
+			t.Errorf("Expected %v for %s, got %v", want, m, v)
+		}
+	}
+}
+
+func TestGenericQueryScrapeErrors(t *testing.T) {
+	response := `{"number_of_nodes":1}`
+	status := http.StatusOK
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			fmt.Fprintln(w, `{"cluster_name":"elasticsearch"}`)
+			return
+		}
+		w.WriteHeader(status)
+		fmt.Fprintln(w, response)
+	}))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatalf("Failed to parse URL: %s", err)
+	}
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"})
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+
+	scrape := func() {
+		ch := make(chan prometheus.Metric, 100)
+		c.Collect(ch)
+		close(ch)
+	}
+	scrape()
+	status = http.StatusNotFound
+	scrape()
+	status, response = http.StatusOK, `{broken`
+	scrape()
+	scrape()
+	ts.Close()
+	scrape()
+
+	for reason, want := range map[string]float64{"connection": 1, "http_status": 1, "parse": 2} {
+		if v := counterValue(t, c.paths[0].scrapeErrors.WithLabelValues(reason)); v != want {
+			t.Errorf("Expected %v %s errors, got %v", want, reason, v)
+		}
+	}
+	if v := counterValue(t, c.paths[0].totalScrapes); v != 5 {
+		t.Errorf("Expected 5 scrapes, got %v", v)
+	}
+}
+
+func TestGenericQueryUnhandledFields(t *testing.T) {
+	c := newTestExporter(t, `{"number_of_nodes":1,"unassigned_info":null,"shards":[{"node":null}]}`)
+
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	if v := counterValue(t, c.paths[0].unhandledFields); v != 2 {
+		t.Errorf("Expected 2 unhandled fields, got %v", v)
+	}
+}
+
+func TestGenericQueryEmptyBody(t *testing.T) {
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			fmt.Fprintln(w, `{"cluster_name":"elasticsearch"}`)
+			return
+		}
+		fmt.Fprintln(w, "")
+	}))
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"})
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	if v := gaugeValue(t, c.paths[0].up); v != 0 {
+		t.Errorf("Expected up to be 0, got %v", v)
+	}
+	if v := counterValue(t, c.paths[0].jsonParseFailures); v != 0 {
+		t.Errorf("Expected no JSON parse failures, got %v", v)
+	}
+}
+
+func TestGenericQueryLastParseError(t *testing.T) {
+	body := `{"settings":"{broken"}`
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, body)
+	}))
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"})
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+
+	lastParseErrors := func() map[string]float64 {
+		ch := make(chan prometheus.Metric, 10)
+		c.paths[0].lastParseError.Collect(ch)
+		close(ch)
+		errs := make(map[string]float64)
+		for m := range ch {
+			pb := &dto.Metric{}
+			if err := m.Write(pb); err != nil {
+				t.Fatalf("Failed to write metric: %s", err)
+			}
+			errs[pb.GetLabel()[0].GetValue()] = pb.GetGauge().GetValue()
+		}
+		return errs
+	}
+
+	for _, clean := range []bool{false, true} {
+		if clean {
+			body = `{"number_of_nodes":1}`
+		}
+		ch := make(chan prometheus.Metric, 100)
+		c.Collect(ch)
+		close(ch)
+
+		errs := lastParseErrors()
+		if len(errs) != 1 {
+			t.Fatalf("[clean %v] Expected 1 series, got %v", clean, errs)
+		}
+		for msg, v := range errs {
+			if clean && (msg != "" || v != 0) {
+				t.Errorf("Expected the error to be reset, got %q: %v", msg, v)
+			}
+			if !clean && (!strings.HasPrefix(msg, "invalid character") || v != 1) {
+				t.Errorf("Expected the parse error, got %q: %v", msg, v)
+			}
+		}
+	}
+
+	c.paths[0].parseError = strings.Repeat("x", 2*maxParseErrorLength)
+	c.paths[0].setLastParseError()
+	for msg := range lastParseErrors() {
+		if len(msg) != maxParseErrorLength+3 || !strings.HasSuffix(msg, "...") {
+			t.Errorf("Expected the error to be truncated, got %q", msg)
+		}
+	}
+}
+
+func TestGenericQueryFilter(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"jvm":{"mem":{"heap_used_in_bytes":1,"heap_max_in_bytes":2},"uptime_in_millis":3},"timestamp":4}`)
+	}))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatalf("Failed to parse URL: %s", err)
+	}
+
+	tcs := map[string]struct {
+		opts []Option
+		want []string
+	}{
+		"none": {
+			want: []string{"jvm_mem_heap_used_in_bytes", "jvm_mem_heap_max_in_bytes", "jvm_uptime_in_millis", "timestamp"},
+		},
+		"include": {
+			opts: []Option{WithInclude(regexp.MustCompile("jvm_mem"))},
+			want: []string{"jvm_mem_heap_used_in_bytes", "jvm_mem_heap_max_in_bytes"},
+		},
+		"exclude": {
+			opts: []Option{WithExclude(regexp.MustCompile("timestamp$|_max_"))},
+			want: []string{"jvm_mem_heap_used_in_bytes", "jvm_uptime_in_millis"},
+		},
+		"include and exclude": {
+			opts: []Option{
+				WithInclude(regexp.MustCompile("jvm_mem")),
+				WithExclude(regexp.MustCompile("_max_")),
+			},
+			want: []string{"jvm_mem_heap_used_in_bytes"},
+		},
+	}
+	for name, tc := range tcs {
+		c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_nodes/stats"}, tc.opts...)
+		if err != nil {
+			t.Fatalf("Failed to create generic query: %s", err)
+		}
+
+		ch := make(chan prometheus.Metric, 100)
+		c.Collect(ch)
+		close(ch)
+		if len(c.paths[0].gauges) != len(tc.want) {
+			t.Errorf("[%s] Expected %d gauges, got %d", name, len(tc.want), len(c.paths[0].gauges))
+		}
+		for _, m := range tc.want {
+			if _, ok := c.paths[0].gauges[m]; !ok {
+				t.Errorf("[%s] %s wasn't exported", name, m)
+			}
+		}
+	}
+}
+
+func TestGenericQueryNumberPrecision(t *testing.T) {
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"docs_count":9007199254740993,"huge":1e400,"shards":[{"id":12345678901234567890,"size":1}]}`)
+	}))
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_stats"}, WithArrayLabelKey("id"))
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	g, ok := c.paths[0].gauges["docs_count"]
+	if !ok {
+		t.Fatalf("docs_count wasn't exported")
+	}
+	if v := gaugeValue(t, g.WithLabelValues("")); v != 9007199254740992 {
+		t.Errorf("Expected 9007199254740992, got %v", v)
+	}
+	if _, ok := c.paths[0].gauges["huge"]; ok {
+		t.Errorf("Out of range number was exported")
+	}
+	if v := counterValue(t, c.paths[0].jsonParseFailures); v != 0 {
+		t.Errorf("Expected no JSON parse failures, got %v", v)
+	}
+	g, ok = c.paths[0].gauges["shards_size"]
+	if !ok {
+		t.Fatalf("shards_size wasn't exported")
+	}
+	if v := gaugeValue(t, g.WithLabelValues("", "12345678901234567890")); v != 1 {
+		t.Errorf("Expected the id label to keep all digits, got %v", v)
+	}
+}
+
+func TestGenericQueryDebug(t *testing.T) {
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"number_of_nodes":1}`)
+	}))
+
+	for _, debug := range []bool{false, true} {
+		var buf bytes.Buffer
+		c, err := NewGenericQuery(log.NewLogfmtLogger(&buf), http.DefaultClient, u, []string{"_cluster/health"}, WithDebug(debug))
+		if err != nil {
+			t.Fatalf("Failed to create generic query: %s", err)
+		}
+
+		ch := make(chan prometheus.Metric, 100)
+		c.Collect(ch)
+		close(ch)
+		if logged := strings.Contains(buf.String(), "number_of_nodes=\"is float\""); logged != debug {
+			t.Errorf("[debug=%v] Unexpected debug output: %s", debug, buf.String())
+		}
+	}
+}
+
+func TestGenericQueryStringValues(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"status":"yellow","mode":"fast","name":"es1"}`)
+	}))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatalf("Failed to parse URL: %s", err)
+	}
+
+	tcs := map[string]struct {
+		opts []Option
+		want map[string]float64
+	}{
+		"default": {
+			want: map[string]float64{"status": 1},
+		},
+		"custom": {
+			opts: []Option{
+				WithStringValues("status", nil),
+				WithStringValues("mode", map[string]float64{"slow": 0, "fast": 1}),
+			},
+			want: map[string]float64{"mode": 1},
+		},
+	}
+	for name, tc := range tcs {
+		c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"}, tc.opts...)
+		if err != nil {
+			t.Fatalf("Failed to create generic query: %s", err)
+		}
+
+		ch := make(chan prometheus.Metric, 100)
+		c.Collect(ch)
+		close(ch)
+		if len(c.paths[0].gauges) != len(tc.want) {
+			t.Errorf("[%s] Expected %d gauges, got %d", name, len(tc.want), len(c.paths[0].gauges))
+		}
+		for m, want := range tc.want {
+			g, ok := c.paths[0].gauges[m]
+			if !ok {
+				t.Errorf("[%s] %s wasn't exported", name, m)
+				continue
+			}
+			if v := gaugeValue(t, g.WithLabelValues("")); v != want {
+				t.Errorf("[%s] Expected %s to be %v, got %v", name, m, want, v)
+			}
+		}
+	}
+}
+
+func TestGenericQueryParseNumericStrings(t *testing.T) {
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"docs_count":"42","health":"green","pri":"1.5"}`)
+	}))
+
+	for _, parse := range []bool{false, true} {
+		c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_stats"}, WithParseNumericStrings(parse))
+		if err != nil {
+			t.Fatalf("Failed to create generic query: %s", err)
+		}
+
+		ch := make(chan prometheus.Metric, 100)
+		c.Collect(ch)
+		close(ch)
+		if !parse {
+			if len(c.paths[0].gauges) != 0 {
+				t.Errorf("Expected no gauges without parsing, got %d", len(c.paths[0].gauges))
+			}
+			continue
+		}
+		if len(c.paths[0].gauges) != 2 {
+			t.Errorf("Expected 2 gauges, got %d", len(c.paths[0].gauges))
+		}
+		for m, want := range map[string]float64{"docs_count": 42, "pri": 1.5} {
+			g, ok := c.paths[0].gauges[m]
+			if !ok {
+				t.Errorf("%s wasn't exported", m)
+				continue
+			}
+			if v := gaugeValue(t, g.WithLabelValues("")); v != want {
+				t.Errorf("Expected %s to be %v, got %v", m, want, v)
+			}
+		}
+	}
+}
+
+func TestGenericQueryNonFinite(t *testing.T) {
+	c := newTestExporter(t, `{"ratio":"NaN","rate":"+Inf","docs_count":"42"}`, WithParseNumericStrings(true))
+
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	if len(c.paths[0].gauges) != 1 {
+		t.Errorf("Expected 1 gauge, got %d", len(c.paths[0].gauges))
+	}
+	if _, ok := c.paths[0].gauges["docs_count"]; !ok {
+		t.Errorf("docs_count wasn't exported")
+	}
+}
+
+func TestGenericQueryDropHumanReadable(t *testing.T) {
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"jvm":{"heap_used":"1kb","heap_used_in_bytes":1024,"uptime":"1s","uptime_in_millis":1000,"heap_max":"2kb"}}`)
+	}))
+	tcs := map[bool][]string{
+		false: {"jvm_heap_used", "jvm_heap_used_in_bytes", "jvm_uptime_seconds", "jvm_uptime_in_millis", "jvm_heap_max"},
+		true:  {"jvm_heap_used_in_bytes", "jvm_uptime_in_millis", "jvm_heap_max"},
+	}
+	for drop, want := range tcs {
+		c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_nodes/stats"}, WithByteUnits(1024), WithParseDurations(true), WithDropHumanReadable(drop))
+		if err != nil {
+			t.Fatalf("Failed to create generic query: %s", err)
+		}
+
+		ch := make(chan prometheus.Metric, 100)
+		c.Collect(ch)
+		close(ch)
+		if len(c.paths[0].gauges) != len(want) {
+			t.Errorf("[drop %v] Expected %d gauges, got %d", drop, len(want), len(c.paths[0].gauges))
+		}
+		for _, m := range want {
+			if _, ok := c.paths[0].gauges[m]; !ok {
+				t.Errorf("[drop %v] %s wasn't exported", drop, m)
+			}
+		}
+	}
+}
+
+func TestGenericQuerySkipZeros(t *testing.T) {
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"relocating_shards":0,"active_shards":5}`)
+	}))
+	for _, skip := range []bool{false, true} {
+		c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"}, WithSkipZeros(skip))
+		if err != nil {
+			t.Fatalf("Failed to create generic query: %s", err)
+		}
+
+		ch := make(chan prometheus.Metric, 100)
+		c.Collect(ch)
+		close(ch)
+		if _, ok := c.paths[0].gauges["active_shards"]; !ok {
+			t.Errorf("[skip %v] active_shards wasn't exported", skip)
+		}
+		if _, ok := c.paths[0].gauges["relocating_shards"]; ok == skip {
+			t.Errorf("[skip %v] Unexpected export of relocating_shards: %v", skip, ok)
+		}
+	}
+}
+
+func TestParseBytes(t *testing.T) {
+	tcs := []struct {
+		in   string
+		base float64
+		want float64
+		ok   bool
+	}{
+		{"512b", 1024, 512, true},
+		{"1kb", 1000, 1000, true},
+		{"1kb", 1024, 1024, true},
+		{"1.5mb", 1024, 1.5 * 1024 * 1024, true},
+		{"2GB", 1000, 2e9, true},
+		{"1tb", 1024, 1024 * 1024 * 1024 * 1024, true},
+		{"green", 1024, 0, false},
+		{"12", 1024, 0, false},
+		{"1.2.3gb", 1024, 0, false},
+	}
+	for _, tc := range tcs {
+		v, ok := parseBytes(tc.in, tc.base)
+		if ok != tc.ok || v != tc.want {
+			t.Errorf("parseBytes(%q, %v) = %v, %v; want %v, %v", tc.in, tc.base, v, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestFloatValue(t *testing.T) {
+	tcs := []struct {
+		in   interface{}
+		want float64
+		ok   bool
+	}{
+		{1, 1, true},
+		{2.5, 2.5, true},
+		{json.Number("42"), 42, true},
+		{json.Number("1e400"), math.Inf(1), true},
+		{json.Number("x"), 0, false},
+		{"1", 0, false},
+		{true, 0, false},
+	}
+	for _, tc := range tcs {
+		v, err := floatValue(tc.in)
+		if (err == nil) != tc.ok || v != tc.want {
+			t.Errorf("floatValue(%#v) = %v, %v; want %v", tc.in, v, err, tc.want)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tcs := []struct {
+		in   string
+		want float64
+		ok   bool
+	}{
+		{"350ms", 0.35, true},
+		{"1.5s", 1.5, true},
+		{"2m", 120, true},
+		{"1h", 3600, true},
+		{"7d", 7 * 86400, true},
+		{"512mb", 0, false},
+		{"green", 0, false},
+		{"12", 0, false},
+	}
+	for _, tc := range tcs {
+		v, ok := parseDuration(tc.in)
+		if ok != tc.ok || v != tc.want {
+			t.Errorf("parseDuration(%q) = %v, %v; want %v, %v", tc.in, v, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestGenericQueryCollisions(t *testing.T) {
+	c := newTestExporter(t, `{"up":1,"nodes":{"AbC123":{"count":1}},"nodes_count":2}`, WithLabelKey("nodes", "node"))
+
+	for i := 0; i < 2; i++ {
+		ch := make(chan prometheus.Metric, 100)
+		c.Collect(ch)
+		close(ch)
+		if len(c.paths[0].gauges) != 1 {
+			t.Errorf("[scrape %d] Expected 1 gauge, got %d", i, len(c.paths[0].gauges))
+		}
+		if _, ok := c.paths[0].gauges["up"]; ok {
+			t.Errorf("[scrape %d] up shadows the self-metric", i)
+		}
+		if _, ok := c.paths[0].gauges["nodes_count"]; !ok {
+			t.Errorf("[scrape %d] nodes_count wasn't exported", i)
+		}
+	}
+}
+
+func TestGenericQueryCrossPathCollisions(t *testing.T) {
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"cluster_name":"elasticsearch","health_up":1,"number_of_nodes":1}`)
+	}))
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster", "_cluster/health"})
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+	registry, err := NewRegistry(c)
+	if err != nil {
+		t.Fatalf("Failed to register generic query: %s", err)
+	}
+	if _, err := registry.Gather(); err != nil {
+		t.Fatalf("Failed to gather metrics: %s", err)
+	}
+	if _, ok := c.paths[0].gauges["health_up"]; ok {
+		t.Errorf("health_up of _cluster shadows the up self-metric of _cluster/health")
+	}
+	if _, ok := c.paths[0].gauges["number_of_nodes"]; !ok {
+		t.Errorf("number_of_nodes wasn't exported")
+	}
+}
+
+func TestSanitizeMetricName(t *testing.T) {
+	tcs := []struct {
+		in           string
+		separator    string
+		preserveCase bool
+		want         string
+	}{
+		{"number_of_nodes", "_", false, "number_of_nodes"},
+		{"Indices_Docs", "_", false, "indices_docs"},
+		{"Indices_Docs", "_", true, "Indices_Docs"},
+		{"mappings_message.keyword_count", "_", false, "mappings_message_keyword_count"},
+		{"fields_@timestamp_count", "_", false, "fields_timestamp_count"},
+		{"thread-pool__write--queue", "_", false, "thread_pool_write_queue"},
+		{"thread_pool_Foo.queue", "_", true, "thread_pool_Foo_queue"},
+		{"95th_percentile", "_", false, "_95th_percentile"},
+		{"jvm_mem__heap_used", "__", false, "jvm_mem__heap_used"},
+		{"thread-pool__write--queue", "__", false, "thread_pool__write_queue"},
+		{"Nodes_X_Os", "_X_", false, "nodes_x_os"},
+	}
+	for _, tc := range tcs {
+		if got := sanitizeMetricName(tc.in, tc.separator, tc.preserveCase); got != tc.want {
+			t.Errorf("sanitizeMetricName(%q, %q, %v) = %q; want %q", tc.in, tc.separator, tc.preserveCase, got, tc.want)
+		}
+	}
+}
+
+func TestGenericQuerySanitizeCollision(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		c := newTestExporter(t, `{"docs-count":1,"docs.count":2,"docs_count":3}`)
+
+		ch := make(chan prometheus.Metric, 100)
+		c.Collect(ch)
+		close(ch)
+		g, ok := c.paths[0].gauges["docs_count"]
+		if !ok {
+			t.Fatalf("docs_count wasn't exported")
+		}
+		if v := gaugeValue(t, g.WithLabelValues("elasticsearch")); v != 1 {
+			t.Fatalf("Expected the first key in order to win, got %v", v)
+		}
+	}
+}
+
+func TestGenericQueryEmptyKey(t *testing.T) {
+	c := newTestExporter(t, `{"":1,"number_of_nodes":2}`)
+	registry, err := NewRegistry(c)
+	if err != nil {
+		t.Fatalf("Failed to register generic query: %s", err)
+	}
+	if _, err := registry.Gather(); err != nil {
+		t.Fatalf("Failed to gather metrics: %s", err)
+	}
+	if _, ok := c.paths[0].gauges[""]; ok {
+		t.Errorf("Expected the empty key to be skipped")
+	}
+	if _, ok := c.paths[0].gauges["number_of_nodes"]; !ok {
+		t.Errorf("number_of_nodes wasn't exported")
+	}
+}
+
+func TestGenericQuerySeparator(t *testing.T) {
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"jvm":{"mem":{"heap_used":1}},"jvm_mem":{"heap":{"used":2}},"pools":[{"size":3}]}`)
+	}))
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_nodes/stats"}, WithSeparator("__"))
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	for _, m := range []string{"jvm__mem__heap_used", "jvm_mem__heap__used", "pools__0__size"} {
+		if _, ok := c.paths[0].gauges[m]; !ok {
+			t.Errorf("%s wasn't exported", m)
+		}
+	}
+
+	for _, separator := range []string{"-", ".", "_ _"} {
+		if _, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_nodes/stats"}, WithSeparator(separator)); err == nil {
+			t.Errorf("Expected an error for the separator %q", separator)
+		}
+	}
+}
+
+func TestGenericQueryLabelKey(t *testing.T) {
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			fmt.Fprintln(w, `{"cluster_name":"elasticsearch"}`)
+			return
+		}
+		fmt.Fprintln(w, `{"cluster_name":"elasticsearch","nodes":{"AbC123":{"jvm":{"uptime_in_millis":1}},"DeF456":{"jvm":{"uptime_in_millis":2}}}}`)
+	}))
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_nodes/stats"}, WithLabelKey("nodes", "node"))
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	if len(c.paths[0].gauges) != 1 {
+		t.Errorf("Expected 1 gauge, got %d", len(c.paths[0].gauges))
+	}
+	g, ok := c.paths[0].gauges["nodes_jvm_uptime_in_millis"]
+	if !ok {
+		t.Fatalf("nodes_jvm_uptime_in_millis wasn't exported")
+	}
+	for node, want := range map[string]float64{"AbC123": 1, "DeF456": 2} {
+		if v := gaugeValue(t, g.WithLabelValues("elasticsearch", node)); v != want {
+			t.Errorf("Expected %v for node %s, got %v", want, node, v)
+		}
+	}
+
+	_, err = NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_nodes/stats"}, WithLabelKey("nodes", "node-id"))
+	if err == nil {
+		t.Errorf("Expected an error for an invalid label name")
+	}
+}
+
+func TestGenericQueryLabelKeyClash(t *testing.T) {
+	c := newTestExporter(t, `{"nodes":{"AbC123":{"indices":{"logs":{"docs":1}}}}}`, WithLabelKey("nodes", "node"))
+	// Bypass validate to nest two label keys setting the same label.
+	c.LabelKeys["nodes_indices"] = "node"
+	registry, err := NewRegistry(c)
+	if err != nil {
+		t.Fatalf("Failed to register generic query: %s", err)
+	}
+	if _, err := registry.Gather(); err != nil {
+		t.Fatalf("Failed to gather metrics: %s", err)
+	}
+	g, ok := c.paths[0].gauges["nodes_indices_logs_docs"]
+	if !ok {
+		t.Fatalf("nodes_indices_logs_docs wasn't exported")
+	}
+	if v := gaugeValue(t, g.WithLabelValues("elasticsearch", "AbC123")); v != 1 {
+		t.Errorf("Expected 1, got %v", v)
+	}
+
+	for _, opts := range [][]Option{
+		{WithLabelKey("nodes", "node"), WithLabelKey("nodes_indices", "node")},
+		{WithLabelKey("nodes", "node"), WithArrayLabel("node")},
+		{WithLabelKey("nodes", "node"), WithArrayLabelKey("node")},
+	} {
+		if _, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, c.url, []string{"_nodes/stats"}, opts...); err == nil {
+			t.Errorf("Expected an error for clashing labels")
+		}
+	}
+}
+
+func TestGenericQueryNodeFilter(t *testing.T) {
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			fmt.Fprintln(w, `{"cluster_name":"elasticsearch"}`)
+			return
+		}
+		fmt.Fprintln(w, `{"_nodes":{"total":2},"nodes":{"AbC123":{"name":"es1","jvm":{"uptime_in_millis":1}},"DeF456":{"name":"es2","jvm":{"uptime_in_millis":2}}}}`)
+	}))
+	for _, node := range []string{"DeF456", "es2"} {
+		c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_nodes/stats"}, WithLabelKey("nodes", "node"), WithNodeFilter(node))
+		if err != nil {
+			t.Fatalf("Failed to create generic query: %s", err)
+		}
+
+		ch := make(chan prometheus.Metric, 100)
+		c.Collect(ch)
+		close(ch)
+		if _, ok := c.paths[0].gauges["nodes_total"]; !ok {
+			t.Errorf("[%s] nodes_total wasn't exported", node)
+		}
+		g, ok := c.paths[0].gauges["nodes_jvm_uptime_in_millis"]
+		if !ok {
+			t.Fatalf("[%s] nodes_jvm_uptime_in_millis wasn't exported", node)
+		}
+		if v := gaugeValue(t, g.WithLabelValues("elasticsearch", "DeF456")); v != 2 {
+			t.Errorf("[%s] Expected 2 for node DeF456, got %v", node, v)
+		}
+		mch := make(chan prometheus.Metric, 10)
+		g.Collect(mch)
+		close(mch)
+		if len(mch) != 1 {
+			t.Errorf("[%s] Expected the stats of 1 node, got %d", node, len(mch))
+		}
+	}
+}
+
+func TestGenericQueryArrayLabel(t *testing.T) {
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"fs":{"data":[{"free_in_bytes":1},{"free_in_bytes":2}]}}`)
+	}))
+
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_nodes/stats"})
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	for _, m := range []string{"fs_data_0_free_in_bytes", "fs_data_1_free_in_bytes"} {
+		if _, ok := c.paths[0].gauges[m]; !ok {
+			t.Errorf("%s wasn't exported", m)
+		}
+	}
+
+	c, err = NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_nodes/stats"}, WithArrayLabel("index"))
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+	ch = make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	if len(c.paths[0].gauges) != 1 {
+		t.Errorf("Expected 1 gauge, got %d", len(c.paths[0].gauges))
+	}
+	g, ok := c.paths[0].gauges["fs_data_free_in_bytes"]
+	if !ok {
+		t.Fatalf("fs_data_free_in_bytes wasn't exported")
+	}
+	for index, want := range map[string]float64{"0": 1, "1": 2} {
+		if v := gaugeValue(t, g.WithLabelValues("", index)); v != want {
+			t.Errorf("Expected %v for index %s, got %v", want, index, v)
+		}
+	}
+}
+
+func TestGenericQueryArrayLabelKey(t *testing.T) {
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"fs":{"data":[{"mount":"/data","free_in_bytes":1},{"free_in_bytes":2}]}}`)
+	}))
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_nodes/stats"}, WithArrayLabelKey("mount"))
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	g, ok := c.paths[0].gauges["fs_data_free_in_bytes"]
+	if !ok {
+		t.Fatalf("fs_data_free_in_bytes wasn't exported")
+	}
+	for mount, want := range map[string]float64{"/data": 1, "1": 2} {
+		if v := gaugeValue(t, g.WithLabelValues("", mount)); v != want {
+			t.Errorf("Expected %v for mount %s, got %v", want, mount, v)
+		}
+	}
+}
+
+func TestGenericQueryStaticLabels(t *testing.T) {
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"number_of_nodes":1}`)
+	}))
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"},
+		WithStaticLabels(map[string]string{"datacenter": "eu1", "environment": "prod"}),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	g, ok := c.paths[0].gauges["number_of_nodes"]
+	if !ok {
+		t.Fatalf("number_of_nodes wasn't exported")
+	}
+	var m dto.Metric
+	if err := g.WithLabelValues("").Write(&m); err != nil {
+		t.Fatalf("Failed to write gauge: %s", err)
+	}
+	labels := make(map[string]string)
+	for _, l := range m.GetLabel() {
+		labels[l.GetName()] = l.GetValue()
+	}
+	if labels["datacenter"] != "eu1" || labels["environment"] != "prod" {
+		t.Errorf("Static labels are missing: %v", labels)
+	}
+
+	for _, invalid := range []string{"cluster", "data-center", "0dc", "__dc"} {
+		_, err = NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"},
+			WithStaticLabels(map[string]string{invalid: "eu1"}),
+		)
+		if err == nil {
+			t.Errorf("Expected an error for the static label %q", invalid)
+		}
+	}
+}
+
+func TestGenericQueryClusterLabel(t *testing.T) {
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"cluster_name":"elasticsearch","number_of_nodes":1}`)
+	}))
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"}, WithClusterLabel("es_cluster"))
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	g, ok := c.paths[0].gauges["number_of_nodes"]
+	if !ok {
+		t.Fatalf("number_of_nodes wasn't exported")
+	}
+	if v := gaugeValue(t, g.With(prometheus.Labels{"es_cluster": "elasticsearch"})); v != 1 {
+		t.Errorf("Expected number_of_nodes{es_cluster=\"elasticsearch\"} to be 1, got %v", v)
+	}
+
+	for _, label := range []string{"es-cluster", "__cluster"} {
+		if _, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"}, WithClusterLabel(label)); err == nil {
+			t.Errorf("Expected an error for the invalid cluster label %q", label)
+		}
+	}
+	for _, label := range []string{"uuid", "version"} {
+		if _, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"}, WithClusterLabel(label)); err == nil {
+			t.Errorf("Expected an error for the cluster label %q conflicting with cluster_info", label)
+		}
+	}
+}
+
+func TestGenericQueryOmitClusterLabel(t *testing.T) {
+	c := newTestExporter(t, `{"cluster_name":"elasticsearch","number_of_nodes":1}`, WithOmitClusterLabel(true))
+
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	if names := c.paths[0].labelNames["number_of_nodes"]; len(names) != 0 {
+		t.Errorf("Expected no labels on number_of_nodes, got %v", names)
+	}
+	g, ok := c.paths[0].gauges["number_of_nodes"]
+	if !ok {
+		t.Fatalf("number_of_nodes wasn't exported")
+	}
+	if v := gaugeValue(t, g.WithLabelValues()); v != 1 {
+		t.Errorf("Expected number_of_nodes to be 1, got %v", v)
+	}
+}
+
+func TestGenericQueryClusterUUIDLabel(t *testing.T) {
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			fmt.Fprintln(w, `{"cluster_name":"elasticsearch","cluster_uuid":"5ZnbuTURQ1-nWvS4H3_j5w"}`)
+			return
+		}
+		fmt.Fprintln(w, `{"number_of_nodes":1}`)
+	}))
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"}, WithClusterUUIDLabel(true))
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+	if c.ClusterUUID != "5ZnbuTURQ1-nWvS4H3_j5w" {
+		t.Errorf("Wrong cluster uuid %q", c.ClusterUUID)
+	}
+
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	g, ok := c.paths[0].gauges["number_of_nodes"]
+	if !ok {
+		t.Fatalf("number_of_nodes wasn't exported")
+	}
+	if v := gaugeValue(t, g.WithLabelValues("elasticsearch", "5ZnbuTURQ1-nWvS4H3_j5w")); v != 1 {
+		t.Errorf("Expected number_of_nodes to be 1, got %v", v)
+	}
+}
+
+func TestGenericQueryClusterInfo(t *testing.T) {
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"cluster_name":"elasticsearch","cluster_uuid":"5ZnbuTURQ1-nWvS4H3_j5w","version":{"number":"5.4.2"}}`)
+	}))
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"})
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+
+	var m dto.Metric
+	if err := c.paths[0].clusterInfo.Write(&m); err != nil {
+		t.Fatalf("Failed to write gauge: %s", err)
+	}
+	if v := m.GetGauge().GetValue(); v != 1 {
+		t.Errorf("Expected cluster_info to be 1, got %v", v)
+	}
+	want := map[string]string{"cluster": "elasticsearch", "uuid": "5ZnbuTURQ1-nWvS4H3_j5w", "version": "5.4.2"}
+	for _, l := range m.GetLabel() {
+		if want[l.GetName()] != l.GetValue() {
+			t.Errorf("Expected label %s to be %q, got %q", l.GetName(), want[l.GetName()], l.GetValue())
+		}
+	}
+	if len(m.GetLabel()) != len(want) {
+		t.Errorf("Expected %d labels, got %d", len(want), len(m.GetLabel()))
+	}
+}
+
+func TestGenericQueryBody(t *testing.T) {
+	query := `{"size":0,"aggs":{"docs":{"value_count":{"field":"_id"}}}}`
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			fmt.Fprintln(w, `{"cluster_name":"elasticsearch"}`)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/json" || string(body) != query {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintln(w, `{"aggregations":{"docs":{"value":42}}}`)
+	}))
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"twitter/_search"}, WithBody([]byte(query)))
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+	if c.ClusterName != "elasticsearch" {
+		t.Errorf("Wrong cluster name %q", c.ClusterName)
+	}
+
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	if _, ok := c.paths[0].gauges["aggregations_docs_value"]; !ok {
+		t.Errorf("aggregations_docs_value wasn't exported")
+	}
+}
+
+func TestGenericQueryPaths(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprintln(w, `{"cluster_name":"elasticsearch"}`)
+		case "/_cluster/health":
+			fmt.Fprintln(w, `{"number_of_nodes":1}`)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatalf("Failed to parse URL: %s", err)
+	}
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health", "_cluster/stats"})
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	if len(c.paths) != 2 {
+		t.Fatalf("Expected 2 paths, got %d", len(c.paths))
+	}
+	health, stats := c.paths[0], c.paths[1]
+	if health.subsystem != "cluster_health" || stats.subsystem != "cluster_stats" {
+		t.Errorf("Wrong subsystems %q and %q", health.subsystem, stats.subsystem)
+	}
+	if v := gaugeValue(t, health.up); v != 1 {
+		t.Errorf("Expected up of %s to be 1, got %v", health.URI_path, v)
+	}
+	if v := gaugeValue(t, stats.up); v != 0 {
+		t.Errorf("Expected up of %s to be 0, got %v", stats.URI_path, v)
+	}
+	if _, ok := health.gauges["number_of_nodes"]; !ok {
+		t.Errorf("number_of_nodes wasn't exported")
+	}
+	if len(stats.gauges) != 0 {
+		t.Errorf("Expected no gauges from the failing path, got %d", len(stats.gauges))
+	}
+
+	for _, paths := range [][]string{nil, {"_cluster/health", "/_cluster/health"}} {
+		if _, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, paths); err == nil {
+			t.Errorf("Expected an error for paths %v", paths)
+		}
+	}
+}
+
+func TestGenericQueryIndexLabel(t *testing.T) {
+	c := newTestExporter(t, `{"_all":{"primaries":{"docs":{"count":3}}},"indices":{"twitter":{"primaries":{"docs":{"count":1}}},"logs":{"primaries":{"docs":{"count":2}}}}}`, WithIndexLabel(true))
+
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	if len(c.paths[0].gauges) != 2 {
+		t.Errorf("Expected 2 gauges, got %d", len(c.paths[0].gauges))
+	}
+	if _, ok := c.paths[0].gauges["all_primaries_docs_count"]; !ok {
+		t.Errorf("all_primaries_docs_count wasn't exported")
+	}
+	g, ok := c.paths[0].gauges["indices_primaries_docs_count"]
+	if !ok {
+		t.Fatalf("indices_primaries_docs_count wasn't exported")
+	}
+	for index, want := range map[string]float64{"twitter": 1, "logs": 2} {
+		if v := gaugeValue(t, g.WithLabelValues("elasticsearch", index)); v != want {
+			t.Errorf("Expected %v for index %s, got %v", want, index, v)
+		}
+	}
+
+	c = newTestExporter(t, `{"indices":{"twitter":{"primaries":{"docs":{"count":1}}}}}`, WithIndexLabel(true), WithIndexLabel(false))
+	ch = make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	if _, ok := c.paths[0].gauges["indices_twitter_primaries_docs_count"]; !ok {
+		t.Errorf("Expected WithIndexLabel(false) to remove the index label")
+	}
+}
+
+func TestGenericQueryGzip(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !compress || r.URL.Path == "/" || r.Header.Get("Accept-Encoding") != "gzip" {
+				fmt.Fprintln(w, `{"number_of_nodes":1}`)
+				return
+			}
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			fmt.Fprintln(gz, `{"number_of_nodes":1}`)
+			gz.Close()
+		}))
+		defer ts.Close()
+
+		u, err := url.Parse(ts.URL)
+		if err != nil {
+			t.Fatalf("Failed to parse URL: %s", err)
+		}
+		c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"})
+		if err != nil {
+			t.Fatalf("Failed to create generic query: %s", err)
+		}
+
+		ch := make(chan prometheus.Metric, 100)
+		c.Collect(ch)
+		close(ch)
+		if v := gaugeValue(t, c.paths[0].up); v != 1 {
+			t.Errorf("[compress %v] Expected up to be 1, got %v", compress, v)
+		}
+		if _, ok := c.paths[0].gauges["number_of_nodes"]; !ok {
+			t.Errorf("[compress %v] number_of_nodes wasn't exported", compress)
+		}
+	}
+}
+
+// closeRecorder records whether the body was closed.
+type closeRecorder struct {
+	*bytes.Reader
+	closed bool
+}
+
+func (r *closeRecorder) Close() error {
+	r.closed = true
+	return nil
+}
+
+func TestResponseBodyClose(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	fmt.Fprintln(gz, `{"number_of_nodes":1}`)
+	gz.Close()
+
+	body := &closeRecorder{Reader: bytes.NewReader(buf.Bytes())}
+	resp := &http.Response{Header: http.Header{"Content-Encoding": []string{"gzip"}}, Body: body}
+	reader, err := responseBody(resp)
+	if err != nil {
+		t.Fatalf("Failed to decompress body: %s", err)
+	}
+	if b, err := ioutil.ReadAll(reader); err != nil || !bytes.Contains(b, []byte("number_of_nodes")) {
+		t.Errorf("Failed to read decompressed body %q: %v", b, err)
+	}
+	if err := reader.Close(); err != nil {
+		t.Errorf("Failed to close body: %s", err)
+	}
+	if !body.closed {
+		t.Errorf("Expected the response body to be closed")
+	}
+}
+
+func TestGenericQueryTopLevelKeys(t *testing.T) {
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"status":"green","indices":{"count":1,"nodes":{"count":2}},"nodes":{"count":{"total":3}},"timestamp":4}`)
+	}))
+	tcs := map[string]struct {
+		keys []string
+		want []string
+	}{
+		"all":     {nil, []string{"status", "indices_count", "indices_nodes_count", "nodes_count_total", "timestamp"}},
+		"allowed": {[]string{"indices", "nodes"}, []string{"indices_count", "indices_nodes_count", "nodes_count_total"}},
+	}
+	for name, tc := range tcs {
+		c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/stats"}, WithTopLevelKeys(tc.keys))
+		if err != nil {
+			t.Fatalf("Failed to create generic query: %s", err)
+		}
+
+		ch := make(chan prometheus.Metric, 100)
+		c.Collect(ch)
+		close(ch)
+		if len(c.paths[0].gauges) != len(tc.want) {
+			t.Errorf("[%s] Expected %d gauges, got %d", name, len(tc.want), len(c.paths[0].gauges))
+		}
+		for _, m := range tc.want {
+			if _, ok := c.paths[0].gauges[m]; !ok {
+				t.Errorf("[%s] %s wasn't exported", name, m)
+			}
+		}
+	}
+}
+
+func TestGenericQueryMaxDepth(t *testing.T) {
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"status":"green","indices":{"count":1,"docs":{"count":2}},"nodes":[{"id":1},{"os":{"cpu":2}}]}`)
+	}))
+	tcs := map[int][]string{
+		0: {"status", "indices_count", "indices_docs_count", "nodes_0_id", "nodes_1_os_cpu"},
+		1: {"status"},
+		2: {"status", "indices_count"},
+		3: {"status", "indices_count", "indices_docs_count", "nodes_0_id"},
+	}
+	reached := map[int]float64{0: 4, 1: 1, 2: 2, 3: 3}
+	for depth, want := range tcs {
+		c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/stats"}, WithMaxDepth(depth))
+		if err != nil {
+			t.Fatalf("Failed to create generic query: %s", err)
+		}
+
+		ch := make(chan prometheus.Metric, 100)
+		c.Collect(ch)
+		close(ch)
+		if len(c.paths[0].gauges) != len(want) {
+			t.Errorf("[depth %d] Expected %d gauges, got %d", depth, len(want), len(c.paths[0].gauges))
+		}
+		for _, m := range want {
+			if _, ok := c.paths[0].gauges[m]; !ok {
+				t.Errorf("[depth %d] %s wasn't exported", depth, m)
+			}
+		}
+		if v := gaugeValue(t, c.paths[0].maxDepthReached); v != reached[depth] {
+			t.Errorf("[depth %d] Expected the depth %v to be reached, got %v", depth, reached[depth], v)
+		}
+	}
+
+	if _, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/stats"}, WithMaxDepth(-1)); err == nil {
+		t.Errorf("Expected an error for a negative max depth")
+	}
+}
+
+func TestGenericQueryMaxSeries(t *testing.T) {
+	c := newTestExporter(t, `{"a":1,"b":2,"c":3,"d":4}`, WithMaxSeries(3))
+
+	for i := 1; i <= 2; i++ {
+		ch := make(chan prometheus.Metric, 100)
+		c.Collect(ch)
+		close(ch)
+		if len(c.paths[0].gauges) != 3 {
+			t.Errorf("[scrape %d] Expected 3 gauges, got %d", i, len(c.paths[0].gauges))
+		}
+		if v := counterValue(t, c.paths[0].seriesTruncated); v != float64(i) {
+			t.Errorf("[scrape %d] Expected %d truncated series, got %v", i, i, v)
+		}
+	}
+}
+
+func TestGenericQueryPreview(t *testing.T) {
+	status := http.StatusOK
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			fmt.Fprintln(w, `{"cluster_name":"elasticsearch"}`)
+			return
+		}
+		w.WriteHeader(status)
+		fmt.Fprintln(w, `{"number_of_nodes":1,"indices":{"docs":{"count":2}},"status":"green"}`)
+	}))
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health", "_cluster/stats"})
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+
+	names, err := c.Preview()
+	if err != nil {
+		t.Fatalf("Failed to preview: %s", err)
+	}
+	want := []string{
+		"elasticsearch_cluster_health_indices_docs_count",
+		"elasticsearch_cluster_health_number_of_nodes",
+		"elasticsearch_cluster_health_status",
+		"elasticsearch_cluster_stats_indices_docs_count",
+		"elasticsearch_cluster_stats_number_of_nodes",
+		"elasticsearch_cluster_stats_status",
+	}
+	if !equalStrings(names, want) {
+		t.Errorf("Expected the names %v, got %v", want, names)
+	}
+	for _, p := range c.paths {
+		if len(p.gauges) != 0 || counterValue(t, p.totalScrapes) != 0 {
+			t.Errorf("The preview changed the metrics of %s", p.URI_path)
+		}
+	}
+
+	status = http.StatusInternalServerError
+	if _, err := c.Preview(); err == nil {
+		t.Errorf("Expected an error for a failing path")
+	}
+}
+
+func TestGenericQueryClose(t *testing.T) {
+	c := newTestExporter(t, `{"number_of_nodes":1}`, WithMaxIdleConns(1))
+	if err := c.Close(); err != nil {
+		t.Fatalf("Failed to close generic query: %s", err)
+	}
+
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	if len(ch) != 0 {
+		t.Errorf("Expected no metrics after closing, got %d", len(ch))
+	}
+	if v := counterValue(t, c.paths[0].totalScrapes); v != 0 {
+		t.Errorf("Expected no scrapes after closing, got %v", v)
+	}
+	if c.transport == nil {
+		t.Errorf("Expected the exporter to own its transport")
+	}
+
+	shared := newTestExporter(t, `{"number_of_nodes":1}`)
+	if shared.transport != nil {
+		t.Errorf("Expected the shared client's transport not to be owned")
+	}
+}
+
+func TestGenericQueryMaxConcurrency(t *testing.T) {
+	var inFlight, maxInFlight int32
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			fmt.Fprintln(w, `{"cluster_name":"elasticsearch"}`)
+			return
+		}
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		fmt.Fprintln(w, `{"number_of_nodes":1}`)
+	}))
+	paths := []string{"_cluster/health", "_cluster/stats", "_nodes/stats", "_stats", "_cat/indices", "_cat/shards"}
+	for _, concurrency := range []int{0, 1, 2, 6} {
+		maxInFlight = 0
+		c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, paths, WithMaxConcurrency(concurrency))
+		if err != nil {
+			t.Fatalf("Failed to create generic query: %s", err)
+		}
+
+		ch := make(chan prometheus.Metric, 1000)
+		c.Collect(ch)
+		close(ch)
+		want := int32(concurrency)
+		if want == 0 {
+			want = 1
+		}
+		if maxInFlight > want {
+			t.Errorf("[concurrency %d] Expected at most %d parallel requests, got %d", concurrency, want, maxInFlight)
+		}
+		if want > 1 && maxInFlight < 2 {
+			t.Errorf("[concurrency %d] Expected parallel requests", concurrency)
+		}
+		for _, p := range c.paths {
+			if v := gaugeValue(t, p.up); v != 1 {
+				t.Errorf("[concurrency %d] Expected up to be 1 for %s, got %v", concurrency, p.URI_path, v)
+			}
+		}
+	}
+
+	if _, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, paths, WithMaxConcurrency(-1)); err == nil {
+		t.Errorf("Expected an error for a negative max concurrency")
+	}
+}
+
+func TestGenericQueryCacheTTL(t *testing.T) {
+	requests := 0
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			requests++
+		}
+		fmt.Fprintln(w, `{"number_of_nodes":1}`)
+	}))
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"}, WithCacheTTL(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+
+	for i, want := range []int{1, 1, 2} {
+		if i == 2 {
+			time.Sleep(60 * time.Millisecond)
+		}
+		ch := make(chan prometheus.Metric, 100)
+		c.Collect(ch)
+		close(ch)
+		if requests != want {
+			t.Errorf("[scrape %d] Expected %d requests, got %d", i, want, requests)
+		}
+		if len(ch) != 20 {
+			t.Errorf("[scrape %d] Expected the 19 self metrics and 1 gauge, got %d", i, len(ch))
+		}
+	}
+}
+
+func TestGenericQueryCounters(t *testing.T) {
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"indexing":{"index_total":5},"docs_count":3}`)
+	}))
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_stats"}, WithCounters(regexp.MustCompile(`_total$`)))
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	if _, ok := c.paths[0].gauges["docs_count"]; !ok {
+		t.Errorf("docs_count wasn't exported as gauge")
+	}
+	if _, ok := c.paths[0].gauges["indexing_index_total"]; ok {
+		t.Errorf("indexing_index_total was exported as gauge")
+	}
+	if _, ok := c.paths[0].counters["indexing_index_total"]; !ok {
+		t.Fatalf("indexing_index_total wasn't exported as counter")
+	}
+
+	var found bool
+	for m := range ch {
+		if !strings.Contains(m.Desc().String(), `fqName: "elasticsearch_stats_indexing_index_total"`) {
+			continue
+		}
+		found = true
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			t.Fatalf("Failed to write metric: %s", err)
+		}
+		if pb.Counter == nil || pb.Counter.GetValue() != 5 {
+			t.Errorf("Expected a counter of 5, got %v", pb)
+		}
+	}
+	if !found {
+		t.Errorf("indexing_index_total wasn't collected")
+	}
+}
+
+func TestGenericQueryDuplicateCounters(t *testing.T) {
+	c := newTestExporter(t, `{"indexing":{"index_total":5},"indexing_index_total":7}`, WithCounters(regexp.MustCompile(`_total$`)))
+
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	var found int
+	for m := range ch {
+		if strings.Contains(m.Desc().String(), `fqName: "elasticsearch_cluster_health_indexing_index_total"`) {
+			found++
+		}
+	}
+	if found != 1 {
+		t.Errorf("Expected indexing_index_total to be collected once, got %d", found)
+	}
+}
+
+func TestGenericQueryContentType(t *testing.T) {
+	tcs := map[string]struct {
+		contentType string
+		body        string
+		ok          bool
+	}{
+		"json":         {"application/json; charset=UTF-8", `{"number_of_nodes":1}`, true},
+		"vendor json":  {"application/vnd.elasticsearch+json; compatible-with=8", `{"number_of_nodes":1}`, true},
+		"sniffed json": {"text/plain; charset=utf-8", `{"number_of_nodes":1}`, true},
+		"cat text":     {"text/plain; charset=UTF-8", "green open twitter 1", false},
+		"html":         {"text/html", `{"number_of_nodes":1}`, false},
+	}
+	for name, tc := range tcs {
+		tc := tc
+		u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/" {
+				fmt.Fprintln(w, `{"cluster_name":"elasticsearch"}`)
+				return
+			}
+			w.Header().Set("Content-Type", tc.contentType)
+			fmt.Fprintln(w, tc.body)
+		}))
+		c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"})
+		if err != nil {
+			t.Fatalf("Failed to create generic query: %s", err)
+		}
+
+		ch := make(chan prometheus.Metric, 100)
+		c.Collect(ch)
+		close(ch)
+		if failed := counterValue(t, c.paths[0].jsonParseFailures) != 0; failed == tc.ok {
+			t.Errorf("[%s] Expected the response to be accepted: %v, got a parse failure: %v", name, tc.ok, failed)
+		}
+	}
+}
+
+func TestGenericQueryCat(t *testing.T) {
+	u := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			fmt.Fprintln(w, `{"cluster_name":"elasticsearch"}`)
+			return
+		}
+		if r.URL.Query().Get("format") != "json" {
+			w.Header().Set("Content-Type", "text/plain")
+			fmt.Fprintln(w, "green open twitter 1")
+			return
+		}
+		fmt.Fprintln(w, `[{"index":"twitter","health":"green","docs.count":"1"},{"index":"logs","health":"yellow","docs.count":"2"}]`)
+	}))
+	c, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cat/indices"}, WithArrayLabelKey("index"), WithParseNumericStrings(true))
+	if err != nil {
+		t.Fatalf("Failed to create generic query: %s", err)
+	}
+
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	if v := counterValue(t, c.paths[0].jsonParseFailures); v != 0 {
+		t.Errorf("Expected no JSON parse failures, got %v", v)
+	}
+	g, ok := c.paths[0].gauges["docs_count"]
+	if !ok {
+		t.Fatalf("docs_count wasn't exported")
+	}
+	for index, want := range map[string]float64{"twitter": 1, "logs": 2} {
+		if v := gaugeValue(t, g.WithLabelValues("elasticsearch", index)); v != want {
+			t.Errorf("Expected %v for index %s, got %v", want, index, v)
+		}
+	}
+}
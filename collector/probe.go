@@ -0,0 +1,206 @@
+package collector
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// maxProbeExporters is the number of distinct combinations of target and URI
+// paths a ProbeHandler keeps exporters for.
+const maxProbeExporters = 64
+
+// ProbeConfig configures a handler created by ProbeHandler.
+type ProbeConfig struct {
+	Logger log.Logger
+	// Client sends the requests to the configured cluster.
+	Client *http.Client
+	// TargetClient sends the requests to the other targets. It must not
+	// carry what is specific to the configured cluster, like a custom
+	// dialer or a client certificate. http.DefaultClient is used if nil.
+	TargetClient *http.Client
+	// URL is the cluster the options are configured for. Probes of it are
+	// sent with the credentials of the options, probes of other targets
+	// without.
+	URL *url.URL
+	// Targets are the other clusters which may be probed. Targets are
+	// matched by scheme and host, other targets are rejected.
+	Targets []*url.URL
+	// Options are applied to the exporter of every probed target.
+	Options []Option
+}
+
+// ProbeHandler serves the metrics of the cluster given by the target query
+// parameter, like the blackbox_exporter does. The URI paths to query are given
+// by one or more path parameters, e.g.
+// /probe?target=http://es1:9200&path=_cluster/health. The exporter of each
+// target and set of paths is created on the first probe and reused by the
+// following ones, its metrics are gathered apart from the default registry.
+func ProbeHandler(cfg ProbeConfig) http.Handler {
+	return &probeHandler{
+		cfg:      cfg,
+		handlers: make(map[string]http.Handler),
+	}
+}
+
+type probeHandler struct {
+	cfg ProbeConfig
+
+	mutex    sync.Mutex
+	handlers map[string]http.Handler
+}
+
+func (h *probeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	target := params.Get("target")
+	if target == "" {
+		http.Error(w, "target parameter is missing", http.StatusBadRequest)
+		return
+	}
+	u, err := url.Parse(target)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		http.Error(w, fmt.Sprintf("invalid target %q", target), http.StatusBadRequest)
+		return
+	}
+	if !h.allowed(u) {
+		http.Error(w, fmt.Sprintf("target %q is not allowed", target), http.StatusForbidden)
+		return
+	}
+	paths := params["path"]
+	if len(paths) == 0 {
+		http.Error(w, "path parameter is missing", http.StatusBadRequest)
+		return
+	}
+
+	handler, err := h.handler(u, paths)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
+
+// allowed reports whether u is the configured cluster or one of the targets.
+func (h *probeHandler) allowed(u *url.URL) bool {
+	if h.cfg.URL != nil && sameHost(u, h.cfg.URL) {
+		return true
+	}
+	for _, target := range h.cfg.Targets {
+		if sameHost(u, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// handler returns the handler serving the metrics of paths of the cluster at
+// u, creating its exporter on first use.
+func (h *probeHandler) handler(u *url.URL, paths []string) (http.Handler, error) {
+	key := u.String() + "\x00" + strings.Join(paths, "\x00")
+	h.mutex.Lock()
+	handler, ok := h.handlers[key]
+	full := len(h.handlers) >= maxProbeExporters
+	h.mutex.Unlock()
+	if ok {
+		return handler, nil
+	}
+	if full {
+		return nil, fmt.Errorf("too many distinct probes, at most %d are kept", maxProbeExporters)
+	}
+
+	client, opts := h.cfg.Client, h.cfg.Options
+	if h.cfg.URL == nil || !sameHost(u, h.cfg.URL) {
+		client = h.cfg.TargetClient
+		if client == nil {
+			client = http.DefaultClient
+		}
+		opts = append(append([]Option{}, opts...), withoutCredentials())
+	}
+	logger := log.With(h.cfg.Logger, "target", u.Redacted())
+	exporter, err := NewGenericQuery(logger, client, u, paths, opts...)
+	if err != nil {
+		return nil, err
+	}
+	handler, err = Handler(logger, exporter)
+	if err != nil {
+		exporter.Close()
+		return nil, err
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	// A concurrent probe may have created the exporter in the meantime.
+	if other, ok := h.handlers[key]; ok {
+		exporter.Close()
+		return other, nil
+	}
+	h.handlers[key] = handler
+	return handler, nil
+}
+
+// sameHost reports whether a and b have the same scheme and host.
+func sameHost(a, b *url.URL) bool {
+	return strings.EqualFold(a.Scheme, b.Scheme) && strings.EqualFold(a.Host, b.Host)
+}
+
+// withoutCredentials drops the credentials set by the options before, so they
+// aren't sent to targets other than the configured cluster.
+func withoutCredentials() Option {
+	return func(c *GenericExporter) {
+		c.Username, c.Password = "", ""
+		c.BearerToken, c.BearerTokenFile = "", ""
+		c.APIKey = ""
+		c.CertFile, c.KeyFile = "", ""
+		c.Headers = nil
+	}
+}
+
+// Handler serves the metrics of exporter only, gathered apart from the
+// default registry like ProbeHandler does, so it needn't be registered. Several
+// exporters sharing subsystems, e.g. of different clusters, can be served
+// under different paths this way. The outgoing requests are bound to the
+// incoming one.
+func Handler(logger log.Logger, exporter *GenericExporter) (http.Handler, error) {
+	registry, err := NewRegistry(exporter)
+	if err != nil {
+		return nil, err
+	}
+	return ContextHandler(metricsHandler(logger, registry), exporter), nil
+}
+
+// NewRegistry creates a registry holding the given exporters only, to serve
+// their metrics apart from the default registry.
+func NewRegistry(exporters ...*GenericExporter) (*prometheus.Registry, error) {
+	registry := prometheus.NewRegistry()
+	for _, exporter := range exporters {
+		if err := registry.Register(exporter); err != nil {
+			return nil, fmt.Errorf("failed to register the exporter of %s: %w", exporter.url.Redacted(), err)
+		}
+	}
+	return registry, nil
+}
+
+// metricsHandler serves the metrics gathered from registry in the format
+// negotiated with the request, failing it if they are inconsistent.
+func metricsHandler(logger log.Logger, registry *prometheus.Registry) http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{
+		ErrorLog:      errorLogger{logger},
+		ErrorHandling: promhttp.HTTPErrorOnError,
+	})
+}
+
+// errorLogger logs the errors of promhttp handlers as warnings.
+type errorLogger struct {
+	logger log.Logger
+}
+
+func (l errorLogger) Println(v ...interface{}) {
+	level.Warn(l.logger).Log("msg", fmt.Sprint(v...))
+}
@@ -0,0 +1,220 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestProbeHandler(t *testing.T) {
+	var rootRequests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			rootRequests++
+			fmt.Fprintln(w, `{"cluster_name":"elasticsearch"}`)
+		case "/_cluster/health":
+			fmt.Fprintln(w, `{"number_of_nodes":1}`)
+		case "/_cluster/stats":
+			fmt.Fprintln(w, `{"indices":{"count":2}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatalf("Failed to parse URL: %s", err)
+	}
+	probe := httptest.NewServer(ProbeHandler(ProbeConfig{Logger: log.NewNopLogger(), Client: http.DefaultClient, Targets: []*url.URL{u}}))
+	defer probe.Close()
+
+	params := url.Values{
+		"target": {ts.URL},
+		"path":   {"_cluster/health", "_cluster/stats"},
+	}
+	resp, err := http.Get(probe.URL + "?" + params.Encode())
+	if err != nil {
+		t.Fatalf("Failed to probe: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read probe response: %s", err)
+	}
+	for _, want := range []string{
+		"# TYPE elasticsearch_cluster_health_up gauge",
+		`elasticsearch_cluster_health_up{path="_cluster/health",subsystem="cluster_health"} 1`,
+		`elasticsearch_cluster_health_number_of_nodes{cluster="elasticsearch"} 1`,
+		"# TYPE elasticsearch_cluster_stats_total_scrapes counter",
+		`elasticsearch_cluster_stats_indices_count{cluster="elasticsearch"} 2`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("Expected %q in probe response:\n%s", want, body)
+		}
+	}
+
+	resp, err = http.Get(probe.URL + "?" + params.Encode())
+	if err != nil {
+		t.Fatalf("Failed to probe: %s", err)
+	}
+	resp.Body.Close()
+	if rootRequests != 1 {
+		t.Errorf("Expected the exporter to be reused, got %d cluster name queries", rootRequests)
+	}
+
+	for _, query := range []string{
+		"path=_cluster/health",
+		"target=es1:9200&path=_cluster/health",
+		"target=" + url.QueryEscape(ts.URL),
+	} {
+		resp, err := http.Get(probe.URL + "?" + query)
+		if err != nil {
+			t.Fatalf("Failed to probe: %s", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("[%s] Expected status 400, got %d", query, resp.StatusCode)
+		}
+	}
+
+	resp, err = http.Get(probe.URL + "?target=" + url.QueryEscape("http://169.254.169.254") + "&path=latest")
+	if err != nil {
+		t.Fatalf("Failed to probe: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected status 403 for a target not allowed, got %d", resp.StatusCode)
+	}
+}
+
+func TestProbeHandlerCredentials(t *testing.T) {
+	var authorized []string
+	newServer := func() *url.URL {
+		return newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/" {
+				authorized = append(authorized, r.Header.Get("Authorization")+"|"+r.Header.Get("X-Opaque-Id"))
+			}
+			fmt.Fprintln(w, `{"cluster_name":"elasticsearch","number_of_nodes":1}`)
+		}))
+	}
+	configured, other := newServer(), newServer()
+	probe := httptest.NewServer(ProbeHandler(ProbeConfig{
+		Logger:  log.NewNopLogger(),
+		Client:  http.DefaultClient,
+		URL:     configured,
+		Targets: []*url.URL{other},
+		Options: []Option{WithBasicAuth("elastic", "secret"), WithHeaders(map[string]string{"X-Opaque-Id": "exporter"})},
+	}))
+	defer probe.Close()
+
+	for _, target := range []*url.URL{configured, other} {
+		resp, err := http.Get(probe.URL + "?target=" + url.QueryEscape(target.String()) + "&path=_cluster/health")
+		if err != nil {
+			t.Fatalf("Failed to probe: %s", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200 for %s, got %d", target, resp.StatusCode)
+		}
+	}
+	if len(authorized) != 2 || authorized[0] == "|" || authorized[1] != "|" {
+		t.Errorf("Expected credentials and headers to be sent to the configured cluster only, got %q", authorized)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	mux := http.NewServeMux()
+	for _, cluster := range []string{"prod", "staging"} {
+		cluster := cluster
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, `{"cluster_name":%q,"number_of_nodes":1}`+"\n", cluster)
+		}))
+		defer ts.Close()
+		u, err := url.Parse(ts.URL)
+		if err != nil {
+			t.Fatalf("Failed to parse URL: %s", err)
+		}
+		exporter, err := NewGenericQuery(log.NewNopLogger(), http.DefaultClient, u, []string{"_cluster/health"})
+		if err != nil {
+			t.Fatalf("Failed to create generic query: %s", err)
+		}
+		handler, err := Handler(log.NewNopLogger(), exporter)
+		if err != nil {
+			t.Fatalf("Failed to create handler: %s", err)
+		}
+		mux.Handle("/"+cluster, handler)
+	}
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	for _, cluster := range []string{"prod", "staging"} {
+		resp, err := http.Get(server.URL + "/" + cluster)
+		if err != nil {
+			t.Fatalf("Failed to get the metrics of %s: %s", cluster, err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("Failed to read the metrics of %s: %s", cluster, err)
+		}
+		for _, want := range []string{
+			`elasticsearch_cluster_health_up{path="_cluster/health",subsystem="cluster_health"} 1`,
+			fmt.Sprintf(`elasticsearch_cluster_health_number_of_nodes{cluster=%q} 1`, cluster),
+		} {
+			if !strings.Contains(string(body), want) {
+				t.Errorf("Expected %q in the metrics of %s:\n%s", want, cluster, body)
+			}
+		}
+	}
+}
+
+func TestProbeHandlerTargetClient(t *testing.T) {
+	target := newTestURL(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"cluster_name":"elasticsearch","number_of_nodes":1}`)
+	}))
+	var dialed bool
+	configured := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = true
+			return nil, errors.New("dialed the configured cluster")
+		},
+	}}
+	probe := httptest.NewServer(ProbeHandler(ProbeConfig{
+		Logger:  log.NewNopLogger(),
+		Client:  configured,
+		URL:     &url.URL{Scheme: "http", Host: "localhost"},
+		Targets: []*url.URL{target},
+	}))
+	defer probe.Close()
+
+	resp, err := http.Get(probe.URL + "?target=" + url.QueryEscape(target.String()) + "&path=_cluster/health")
+	if err != nil {
+		t.Fatalf("Failed to probe: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read probe response: %s", err)
+	}
+	if dialed {
+		t.Errorf("Expected the target to be probed without the dialer of the configured cluster")
+	}
+	want := `elasticsearch_cluster_health_up{path="_cluster/health",subsystem="cluster_health"} 1`
+	if !strings.Contains(string(body), want) {
+		t.Errorf("Expected %q in probe response:\n%s", want, body)
+	}
+}
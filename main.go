@@ -3,15 +3,18 @@ package main
 import (
 	"flag"
 	"fmt"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
+	"regexp"
 	"strings"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/justwatchcom/elasticsearch_exporter/collector"
+	"github.com/justwatchcom/elasticsearch_exporter/version"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -19,8 +22,64 @@ func main() {
 	var (
 		listenAddress      = flag.String("web.listen-address", ":9108", "Address to listen on for web interface and telemetry.")
 		metricsPath        = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
+		probePath          = flag.String("web.probe-path", "/probe", "Path under which to expose the metrics of the URI paths of a target cluster.")
+		probeEnabled       = flag.Bool("web.probe", false, "Expose the metrics of the URI paths of target clusters under web.probe-path.")
+		probeTargets       = flag.String("web.probe-targets", "", "Comma separated list of URLs of the clusters which may be probed besides es.uri.")
 		esURI              = flag.String("es.uri", "http://localhost:9200", "HTTP API address of an Elasticsearch node.")
 		URI_path_list      = flag.String("es.uri-path-list", "", "URI paths to query.")
+		esUsername         = flag.String("es.username", "", "Username for basic auth against the URI paths.")
+		esPassword         = flag.String("es.password", "", "Password for basic auth against the URI paths.")
+		esBearerToken      = flag.String("es.bearer-token", "", "Bearer token to authenticate against the URI paths.")
+		esBearerTokenFile  = flag.String("es.bearer-token-file", "", "File containing the bearer token to authenticate against the URI paths, read again when it rotates.")
+		esAPIKey           = flag.String("es.api-key", "", "Base64 encoded API key to authenticate against the URI paths.")
+		esHeaders          = flag.String("es.headers", "", "Comma separated list of name=value headers sent with the requests to the URI paths.")
+		esUserAgent        = flag.String("es.user-agent", "", "User-Agent of the requests to the URI paths, defaults to elasticsearch_exporter/<version>.")
+		esInsecure         = flag.Bool("es.insecure-skip-verify", false, "Skip TLS verification when querying the URI paths.")
+		esRetries          = flag.Int("es.retries", 0, "Number of retries of failed queries of the URI paths.")
+		esRetryDelay       = flag.Duration("es.retry-delay", 100*time.Millisecond, "Delay before the first retry, doubled for each following retry.")
+		esMaxIdleConns     = flag.Int("es.max-idle-conns", 0, "Maximum number of idle keep-alive connections when querying the URI paths, 0 keeps the default.")
+		esMaxIdlePerHost   = flag.Int("es.max-idle-conns-per-host", 0, "Maximum number of idle keep-alive connections to the cluster when querying the URI paths, 0 keeps the default.")
+		esIdleConnTimeout  = flag.Duration("es.idle-conn-timeout", 0, "Duration idle keep-alive connections are kept open when querying the URI paths, 0 keeps the default.")
+		esHTTP2            = flag.Bool("es.http2", false, "Attempt HTTP/2 when querying the URI paths over TLS.")
+		esStartupTimeout   = flag.Duration("es.startup-timeout", 10*time.Second, "Timeout for querying the cluster name at startup.")
+		esStartupJitter    = flag.Duration("es.startup-jitter", 0, "Maximum random delay before the first queries of the cluster, to spread out exporters started together.")
+		esTopLevelKeys     = flag.String("es.top-level-keys", "", "Comma separated list of the top level fields of the URI path responses to extract metrics from.")
+		esInclude          = flag.String("es.include", "", "Regexp of flattened metric names of the URI paths to export.")
+		esExclude          = flag.String("es.exclude", "", "Regexp of flattened metric names of the URI paths to drop.")
+		esCounters         = flag.String("es.counters", "", "Regexp of metric names of the URI paths to export as counters instead of gauges.")
+		esPreserveCase     = flag.Bool("es.preserve-case", false, "Keep the case of the keys of the URI path responses in metric names instead of lower-casing them.")
+		esSkipZeros        = flag.Bool("es.skip-zeros", false, "Drop values of the URI path responses which are exactly 0.")
+		esDebug            = flag.Bool("es.debug", false, "Log the inferred type of every field of the URI path responses.")
+		esParseNumbers     = flag.Bool("es.parse-numeric-strings", false, "Export string fields of the URI path responses holding a number.")
+		esByteUnitBase     = flag.Float64("es.byte-unit-base", 0, "Base (1000 or 1024) for parsing human readable sizes of the URI path responses, 0 disables parsing.")
+		esParseDurations   = flag.Bool("es.parse-durations", false, "Export time values of the URI path responses in seconds.")
+		esDropHuman        = flag.Bool("es.drop-human-readable", false, "Drop human readable values of the URI path responses which have an _in_bytes or _in_millis sibling.")
+		esDropBools        = flag.Bool("es.drop-bools", false, "Drop boolean fields of the URI path responses instead of exporting them as 1 or 0.")
+		esDropNumbers      = flag.Bool("es.drop-numbers", false, "Drop numeric fields of the URI path responses.")
+		esDropStrings      = flag.Bool("es.drop-strings", false, "Drop string fields of the URI path responses which would be exported as mapped or parsed values.")
+		esLabelKeys        = flag.String("es.label-keys", "", "Comma separated list of key=label pairs of maps in the URI path responses whose keys are exported as label.")
+		esNodeFilter       = flag.String("es.node-filter", "", "Id or name of the node whose stats are exported from the nodes map of the URI path responses.")
+		esNodeRoles        = flag.Bool("es.node-roles-label", false, "Attach the roles of the nodes in the nodes map of the URI path responses as roles label.")
+		esNodeAttributes   = flag.String("es.node-attribute-labels", "", "Comma separated list of attribute=label pairs of node attributes to attach as labels to the nodes in the nodes map of the URI path responses.")
+		esShardLabels      = flag.Bool("es.shard-labels", false, "Export the per-shard stats of _stats?level=shards responses with index and shard labels instead of one metric name per shard.")
+		esTasksLabel       = flag.Bool("es.tasks-label", false, "Export the running tasks of _tasks responses with a task label instead of one metric name per task.")
+		esIndexLabel       = flag.Bool("es.index-label", false, "Export the per-index stats of _stats responses with an index label instead of one metric name per index.")
+		esArrayLabel       = flag.String("es.array-label", "", "Label carrying the position of array elements of the URI path responses instead of suffixing the metric names.")
+		esArrayLabelKey    = flag.String("es.array-label-key", "", "Field of objects in arrays of the URI path responses whose value is exported as label instead of their position.")
+		esScalarArrays     = flag.String("es.scalar-arrays", "index", "How arrays of numbers of the URI path responses are exported: index suffixes each element with its position, suffix and label export their sum, min, max and count with suffixed names or a stat label.")
+		esStaticLabels     = flag.String("es.static-labels", "", "Comma separated list of name=value labels added to the metrics of the URI paths.")
+		esClusterName      = flag.String("es.cluster-name", "", "Cluster name used for the metrics of the URI paths instead of querying it from the cluster.")
+		esStrictCluster    = flag.Bool("es.strict-cluster-name", false, "Exit if the cluster name can't be fetched instead of exporting the metrics of the URI paths with an empty cluster label.")
+		esOmitCluster      = flag.Bool("es.omit-cluster-label", false, "Drop the cluster label from the metrics of the URI paths.")
+		esClusterLabel     = flag.String("es.cluster-label", "cluster", "Name of the label carrying the cluster name on the metrics of the URI paths.")
+		esClusterUUIDLabel = flag.Bool("es.cluster-uuid-label", false, "Add the cluster uuid as cluster_uuid label to the metrics of the URI paths.")
+		esSeparator        = flag.String("es.separator", "_", "Separator joining the keys of nested fields of the URI path responses in metric names.")
+		esMaxDepth         = flag.Int("es.max-depth", 0, "Nesting depth of the URI path responses up to which fields are exported, 0 means unlimited.")
+		esMaxSeries        = flag.Int("es.max-series", 0, "Number of distinct metric names exported per scrape of a URI path, 0 means unlimited.")
+		esMaxConcurrency   = flag.Int("es.max-concurrency", 1, "Number of URI paths queried in parallel during a scrape.")
+		esCacheTTL         = flag.Duration("es.cache-ttl", 0, "Duration for which the metrics of a successful scrape of a URI path are reused, 0 disables caching.")
+		esSubsystems       = flag.String("es.subsystems", "", "Comma separated list of path=subsystem pairs overriding the subsystem derived from the URI paths.")
+		esNamespace        = flag.String("es.namespace", "elasticsearch", "Namespace of the metrics exported for the URI paths.")
 		esTimeout          = flag.Duration("es.timeout", 5*time.Second, "Timeout for trying to get stats from Elasticsearch.")
 		esAllNodes         = flag.Bool("es.all", false, "Export stats for all nodes in the cluster.")
 		esCA               = flag.String("es.ca", "", "Path to PEM file that conains trusted CAs for the Elasticsearch connection.")
@@ -47,15 +106,36 @@ func main() {
 	// returns nil if not provided and falls back to simple TCP.
 	tlsConfig := createTLSConfig(*esCA, *esClientCert, *esClientPrivateKey)
 
+	transport := &http.Transport{
+		TLSClientConfig: tlsConfig,
+	}
+	// unix:///path/to/socket connects through a Unix domain socket.
+	if esURL.Scheme == "unix" {
+		transport.DialContext = collector.UnixSocketDialer(esURL.Path)
+		esURL = &url.URL{Scheme: "http", Host: "localhost"}
+	}
 	httpClient := &http.Client{
-		Timeout: *esTimeout,
-		Transport: &http.Transport{
-			TLSClientConfig: tlsConfig,
-		},
+		Timeout:   *esTimeout,
+		Transport: transport,
+	}
+
+	// Wait before the first queries, so exporters started together, e.g. by
+	// a rollout, don't scrape the cluster in lockstep.
+	if *esStartupJitter < 0 {
+		level.Error(logger).Log(
+			"msg", "es.startup-jitter must not be negative",
+			"jitter", *esStartupJitter,
+		)
+		os.Exit(1)
+	}
+	if *esStartupJitter > 0 {
+		random := rand.New(rand.NewSource(time.Now().UnixNano()))
+		time.Sleep(time.Duration(random.Int63n(int64(*esStartupJitter))))
 	}
 
 	prometheus.MustRegister(collector.NewClusterHealth(logger, httpClient, esURL))
 	prometheus.MustRegister(collector.NewNodes(logger, httpClient, esURL, *esAllNodes))
+	prometheus.MustRegister(version.NewCollector("elasticsearch_exporter"))
 
 	level.Info(logger).Log(
 		"msg1", "es_uri",
@@ -72,18 +152,218 @@ func main() {
 		"msg12", *URI_path_list,
 	)
 
+	var genericOpts []collector.Option
+	if *esTopLevelKeys != "" {
+		genericOpts = append(genericOpts, collector.WithTopLevelKeys(strings.Split(*esTopLevelKeys, ",")))
+	}
+	if *esInclude != "" {
+		re, err := regexp.Compile(*esInclude)
+		if err != nil {
+			level.Error(logger).Log(
+				"msg", "failed to parse es.include",
+				"err", err,
+			)
+			os.Exit(1)
+		}
+		genericOpts = append(genericOpts, collector.WithInclude(re))
+	}
+	if *esExclude != "" {
+		re, err := regexp.Compile(*esExclude)
+		if err != nil {
+			level.Error(logger).Log(
+				"msg", "failed to parse es.exclude",
+				"err", err,
+			)
+			os.Exit(1)
+		}
+		genericOpts = append(genericOpts, collector.WithExclude(re))
+	}
+
+	if *esCounters != "" {
+		re, err := regexp.Compile(*esCounters)
+		if err != nil {
+			level.Error(logger).Log(
+				"msg", "failed to parse es.counters",
+				"err", err,
+			)
+			os.Exit(1)
+		}
+		genericOpts = append(genericOpts, collector.WithCounters(re))
+	}
+
+	if *esSubsystems != "" {
+		for _, pair := range strings.Split(*esSubsystems, ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				level.Error(logger).Log(
+					"msg", "failed to parse es.subsystems",
+					"pair", pair,
+				)
+				os.Exit(1)
+			}
+			genericOpts = append(genericOpts, collector.WithSubsystem(kv[0], kv[1]))
+		}
+	}
+	if *esLabelKeys != "" {
+		for _, pair := range strings.Split(*esLabelKeys, ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				level.Error(logger).Log(
+					"msg", "failed to parse es.label-keys",
+					"pair", pair,
+				)
+				os.Exit(1)
+			}
+			genericOpts = append(genericOpts, collector.WithLabelKey(kv[0], kv[1]))
+		}
+	}
+
+	if *esNodeAttributes != "" {
+		for _, pair := range strings.Split(*esNodeAttributes, ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				level.Error(logger).Log(
+					"msg", "failed to parse es.node-attribute-labels",
+					"pair", pair,
+				)
+				os.Exit(1)
+			}
+			genericOpts = append(genericOpts, collector.WithNodeAttributeLabel(kv[0], kv[1]))
+		}
+	}
+
+	if *esHeaders != "" {
+		headers := make(map[string]string)
+		for _, pair := range strings.Split(*esHeaders, ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				level.Error(logger).Log(
+					"msg", "failed to parse es.headers",
+					"pair", pair,
+				)
+				os.Exit(1)
+			}
+			headers[kv[0]] = kv[1]
+		}
+		genericOpts = append(genericOpts, collector.WithHeaders(headers))
+	}
+
+	if *esStaticLabels != "" {
+		labels := make(map[string]string)
+		for _, pair := range strings.Split(*esStaticLabels, ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				level.Error(logger).Log(
+					"msg", "failed to parse es.static-labels",
+					"pair", pair,
+				)
+				os.Exit(1)
+			}
+			labels[kv[0]] = kv[1]
+		}
+		genericOpts = append(genericOpts, collector.WithStaticLabels(labels))
+	}
+
+	genericOpts = append([]collector.Option{
+		collector.WithNamespace(*esNamespace),
+		collector.WithBasicAuth(*esUsername, *esPassword),
+		collector.WithBearerToken(*esBearerToken),
+		collector.WithBearerTokenFile(*esBearerTokenFile),
+		collector.WithAPIKey(*esAPIKey),
+		collector.WithUserAgent(*esUserAgent),
+		collector.WithInsecureSkipVerify(*esInsecure),
+		collector.WithRetries(*esRetries, *esRetryDelay),
+		collector.WithMaxIdleConns(*esMaxIdleConns),
+		collector.WithMaxIdleConnsPerHost(*esMaxIdlePerHost),
+		collector.WithIdleConnTimeout(*esIdleConnTimeout),
+		collector.WithHTTP2(*esHTTP2),
+		collector.WithStartupTimeout(*esStartupTimeout),
+		collector.WithDebug(*esDebug),
+		collector.WithPreserveCase(*esPreserveCase),
+		collector.WithSkipZeros(*esSkipZeros),
+		collector.WithParseNumericStrings(*esParseNumbers),
+		collector.WithByteUnits(*esByteUnitBase),
+		collector.WithParseDurations(*esParseDurations),
+		collector.WithDropHumanReadable(*esDropHuman),
+		collector.WithDropBools(*esDropBools),
+		collector.WithDropNumbers(*esDropNumbers),
+		collector.WithDropStrings(*esDropStrings),
+		collector.WithNodeFilter(*esNodeFilter),
+		collector.WithNodeRolesLabel(*esNodeRoles),
+		collector.WithIndexLabel(*esIndexLabel),
+		collector.WithShardLabels(*esShardLabels),
+		collector.WithTasksLabel(*esTasksLabel),
+		collector.WithArrayLabel(*esArrayLabel),
+		collector.WithArrayLabelKey(*esArrayLabelKey),
+		collector.WithScalarArrays(*esScalarArrays),
+		collector.WithClusterNameOverride(*esClusterName),
+		collector.WithStrictClusterName(*esStrictCluster),
+		collector.WithClusterLabel(*esClusterLabel),
+		collector.WithOmitClusterLabel(*esOmitCluster),
+		collector.WithClusterUUIDLabel(*esClusterUUIDLabel),
+		collector.WithSeparator(*esSeparator),
+		collector.WithMaxDepth(*esMaxDepth),
+		collector.WithMaxSeries(*esMaxSeries),
+		collector.WithCacheTTL(*esCacheTTL),
+		collector.WithMaxConcurrency(*esMaxConcurrency),
+	}, genericOpts...)
+
+	var genericExporters []*collector.GenericExporter
 	if len(*URI_path_list) > 0 {
-		for _, URI_path := range strings.Split(*URI_path_list, ",") {
-			prometheus.MustRegister(collector.NewGenericQuery(logger, httpClient, esURL, URI_path))
+		exporter, err := collector.NewGenericQuery(logger, httpClient, esURL, strings.Split(*URI_path_list, ","), genericOpts...)
+		if err != nil {
+			level.Error(logger).Log(
+				"msg", "failed to create generic query",
+				"paths", *URI_path_list,
+				"err", err,
+			)
+			os.Exit(1)
 		}
+		prometheus.MustRegister(exporter)
+		genericExporters = append(genericExporters, exporter)
 	}
 
-	http.Handle(*metricsPath, prometheus.Handler())
+	http.Handle(*metricsPath, collector.ContextHandler(prometheus.Handler(), genericExporters...))
+	if *probeEnabled {
+		var targets []*url.URL
+		for _, target := range strings.Split(*probeTargets, ",") {
+			if target == "" {
+				continue
+			}
+			u, err := url.Parse(target)
+			if err != nil || u.Scheme == "" || u.Host == "" {
+				level.Error(logger).Log(
+					"msg", "invalid probe target",
+					"target", target,
+				)
+				os.Exit(1)
+			}
+			targets = append(targets, u)
+		}
+		// Other targets are only sent the CA, not the socket dialer or
+		// the client certificate of es.uri.
+		targetClient := &http.Client{
+			Timeout: *esTimeout,
+			Transport: &http.Transport{
+				TLSClientConfig: createTLSConfig(*esCA, "", ""),
+			},
+		}
+		http.Handle(*probePath, collector.ProbeHandler(collector.ProbeConfig{
+			Logger:       logger,
+			Client:       httpClient,
+			TargetClient: targetClient,
+			URL:          esURL,
+			Targets:      targets,
+			Options:      genericOpts,
+		}))
+	}
 	http.HandleFunc("/", IndexHandler(*metricsPath))
 
 	level.Info(logger).Log(
 		"msg", "starting elasticsearch_exporter",
 		"addr", *listenAddress,
+		"version", version.Version,
+		"revision", version.Revision,
 	)
 
 	if err := http.ListenAndServe(*listenAddress, nil); err != nil {
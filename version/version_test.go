@@ -0,0 +1,39 @@
+package version
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestNewCollector(t *testing.T) {
+	Version, Revision, Branch = "1.0.0", "abc123", "master"
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(NewCollector("elasticsearch_exporter")); err != nil {
+		t.Fatalf("Failed to register the build info: %s", err)
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Failed to gather the build info: %s", err)
+	}
+	if len(families) != 1 || families[0].GetName() != "elasticsearch_exporter_build_info" {
+		t.Fatalf("Expected elasticsearch_exporter_build_info, got %v", families)
+	}
+	metrics := families[0].GetMetric()
+	if len(metrics) != 1 {
+		t.Fatalf("Expected 1 metric, got %d", len(metrics))
+	}
+	labels := make(map[string]string)
+	for _, l := range metrics[0].GetLabel() {
+		labels[l.GetName()] = l.GetValue()
+	}
+	want := map[string]string{"version": "1.0.0", "revision": "abc123", "branch": "master", "goversion": GoVersion}
+	for name, value := range want {
+		if labels[name] != value {
+			t.Errorf("Expected the label %s to be %q, got %q", name, value, labels[name])
+		}
+	}
+	if v := metrics[0].GetGauge().GetValue(); v != 1 {
+		t.Errorf("Expected the value 1, got %v", v)
+	}
+}